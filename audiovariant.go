@@ -0,0 +1,162 @@
+package rtcrtmp
+
+import (
+	"time"
+
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// encoding names of the rtpmap, upper case like mediaFormats returns them.
+// multiopus is the name chrome uses for opus multistream.
+const (
+	opusName  = "OPUS"
+	pcmuName  = "PCMU"
+	pcmaName  = "PCMA"
+	h264Name  = "H264"
+	multiopus = "MULTIOPUS"
+
+	mimeTypeMultiopus = "audio/multiopus"
+)
+
+// audioEncoding is the audio codec a subscriber negotiated, stereo opus
+// unless its offer prefers G.711 or takes multiopus.
+type audioEncoding int
+
+const (
+	audioOpus audioEncoding = iota
+	audioPCMU
+	audioPCMA
+	audioMultiopus
+)
+
+func (self audioEncoding) String() string {
+	switch self {
+	case audioPCMU:
+		return pcmuName
+	case audioPCMA:
+		return pcmaName
+	case audioMultiopus:
+		return multiopus
+	}
+	return opusName
+}
+
+func (self audioEncoding) isG711() bool {
+	return self == audioPCMU || self == audioPCMA
+}
+
+// audioVariant is an encoding of the router audio besides the stereo opus. It
+// has its own transcoding from the source, which only exists while a
+// subscriber negotiated it. The read loop of the router owns the transcoding.
+type audioVariant struct {
+	encoding   audioEncoding
+	ssrc       uint32
+	codec      webrtc.RTPCodecParameters
+	packetizer rtp.Packetizer
+
+	// setup creates the transcoding for the first subscriber
+	setup     func() (*trans.Transformer, error)
+	transform *trans.Transformer
+	// why setup failed, the variant stays silent
+	err error
+
+	// g711 samples waiting for a whole packet and the time of the first one
+	pending     []byte
+	pendingTime time.Duration
+
+	// rtp timestamps follow the rtmp time, base is the one of time zero
+	base    uint32
+	started bool
+
+	transports map[string]*RTCTransport
+}
+
+func newAudioVariant(encoding audioEncoding, ssrc uint32, setup func() (*trans.Transformer, error), codec webrtc.RTPCodecParameters, payloader rtp.Payloader) *audioVariant {
+
+	return &audioVariant{
+		encoding:   encoding,
+		ssrc:       ssrc,
+		codec:      codec,
+		setup:      setup,
+		packetizer: rtp.NewPacketizer(1200, uint8(codec.PayloadType), ssrc, payloader, rtp.NewRandomSequencer(), codec.ClockRate),
+		transports: make(map[string]*RTCTransport),
+	}
+}
+
+// start sets up the transcoding unless it runs or failed before.
+func (self *audioVariant) start() error {
+
+	if self.transform != nil || self.err != nil {
+		return self.err
+	}
+	self.transform, self.err = self.setup()
+	return self.err
+}
+
+// close stops the transcoding, the next subscriber starts a new one. The rtp
+// timeline continues.
+func (self *audioVariant) close() {
+
+	if self.transform == nil {
+		return
+	}
+	self.transform.Close()
+	self.transform = nil
+	self.pending = self.pending[:0]
+}
+
+// packets transcodes a source packet into rtp packets, each group returned
+// with its rtmp time.
+func (self *audioVariant) packets(packet av.Packet) ([][]*rtp.Packet, []time.Duration, error) {
+
+	if err := self.start(); err != nil {
+		return nil, nil, err
+	}
+
+	pkts, err := self.transform.Do(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if self.encoding.isG711() {
+		out, times := self.cut(pkts)
+		return out, times, nil
+	}
+
+	var out [][]*rtp.Packet
+	var times []time.Duration
+	for _, pkt := range pkts {
+		packets := self.packetizer.Packetize(pkt.Data, opusSamples(pkt.Data))
+		self.stamp(packets, pkt.Time)
+		out = append(out, packets)
+		times = append(times, pkt.Time)
+	}
+	return out, times, nil
+}
+
+// stamp sets the rtp timestamp of packets from their rtmp time.
+func (self *audioVariant) stamp(packets []*rtp.Packet, t time.Duration) {
+
+	if len(packets) == 0 {
+		return
+	}
+
+	if !self.started {
+		self.base = packets[0].Timestamp - self.rtpTime(t)
+		self.started = true
+	}
+	for _, packet := range packets {
+		packet.Timestamp = self.base + self.rtpTime(t)
+		packet.Marker = false
+	}
+}
+
+func (self *audioVariant) rtpTime(t time.Duration) uint32 {
+	if self.encoding.isG711() {
+		return g711RTPTime(t)
+	}
+	return audioRTPTime(t)
+}
@@ -0,0 +1,133 @@
+package rtcrtmp
+
+import (
+	"fmt"
+)
+
+const (
+	naluTypeSlice = 1
+	sliceTypeB    = 1
+)
+
+// BFramePolicy decides what a router does with a source that has B-frames.
+// Browsers play them with a PTS ordered clock, but many decoders judder.
+type BFramePolicy int
+
+const (
+	// BFrameWarn forwards B-frames and logs the first one, the default.
+	BFrameWarn BFramePolicy = iota
+	// BFramePassThrough forwards B-frames silently.
+	BFramePassThrough
+	// BFrameReject stops the router at the first B-frame.
+	BFrameReject
+)
+
+func (self BFramePolicy) String() string {
+
+	switch self {
+	case BFrameWarn:
+		return "warn"
+	case BFramePassThrough:
+		return "passthrough"
+	case BFrameReject:
+		return "reject"
+	}
+	return fmt.Sprintf("BFramePolicy(%d)", int(self))
+}
+
+// hasBFrame tells if one of the slices of the access unit is a B slice.
+func hasBFrame(nalus [][]byte) bool {
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		naluType := nalu[0] & 0x1f
+		if naluType != naluTypeSlice && naluType != naluTypeIDR {
+			continue
+		}
+		if sliceType, ok := parseSliceType(nalu); ok && sliceType%5 == sliceTypeB {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSliceType reads slice_type, the second exp-golomb field of the slice
+// header after first_mb_in_slice.
+func parseSliceType(nalu []byte) (uint, bool) {
+
+	// two ue(v) of a 32 bit value fit in 16 bytes
+	reader := &bitReader{data: unescapeRBSP(nalu[1:], 16)}
+	if _, ok := reader.readUE(); !ok {
+		return 0, false
+	}
+	return reader.readUE()
+}
+
+// unescapeRBSP removes emulation prevention bytes from the first n bytes.
+func unescapeRBSP(data []byte, n int) []byte {
+
+	out := make([]byte, 0, n)
+	zeros := 0
+	for _, b := range data {
+		if len(out) == n {
+			break
+		}
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (self *bitReader) readBit() (uint, bool) {
+
+	if self.pos >= len(self.data)*8 {
+		return 0, false
+	}
+	bit := self.data[self.pos/8] >> (7 - uint(self.pos%8)) & 1
+	self.pos++
+	return uint(bit), true
+}
+
+// readUE reads an unsigned exp-golomb code.
+func (self *bitReader) readUE() (uint, bool) {
+
+	zeros := 0
+	for {
+		bit, ok := self.readBit()
+		if !ok {
+			return 0, false
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, false
+		}
+	}
+
+	value := uint(1)<<uint(zeros) - 1
+	for i := zeros - 1; i >= 0; i-- {
+		bit, ok := self.readBit()
+		if !ok {
+			return 0, false
+		}
+		value += bit << uint(i)
+	}
+	return value, true
+}
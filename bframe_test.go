@@ -0,0 +1,30 @@
+package rtcrtmp
+
+import "testing"
+
+func TestHasBFrame(t *testing.T) {
+
+	// the slice header starts with first_mb_in_slice and slice_type, both
+	// exp-golomb coded
+	for _, test := range []struct {
+		name  string
+		nalus [][]byte
+		want  bool
+	}{
+		{"b slice", [][]byte{{0x41, 0xa0}}, true},
+		{"b slice type 6", [][]byte{{0x01, 0x9c}}, true},
+		{"p slice", [][]byte{{0x41, 0xc0}}, false},
+		{"p slice type 5", [][]byte{{0x41, 0x98}}, false},
+		{"i slice of an idr", [][]byte{{0x65, 0x88}}, false},
+		{"b slice after sps and pps", [][]byte{{0x67, 0x42}, {0x68, 0xce}, {0x41, 0xa0}}, true},
+		// first_mb_in_slice 65535 needs an emulation prevention byte
+		{"escaped header", [][]byte{{0x41, 0x00, 0x00, 0x03, 0x80, 0x00, 0x20}}, true},
+		{"truncated header", [][]byte{{0x41, 0x00}}, false},
+		{"not a slice", [][]byte{{0x06, 0xa0}}, false},
+		{"empty nalu", [][]byte{{}}, false},
+	} {
+		if got := hasBFrame(test.nalus); got != test.want {
+			t.Fatalf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
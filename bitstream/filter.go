@@ -0,0 +1,158 @@
+package bitstream
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Filter turns rtmp video packets into access units ready for packetizing.
+// Parameter sets found in-band replace the known ones, every keyframe starts
+// with exactly one copy of them.
+type Filter struct {
+	// StripAUD drops access unit delimiters, StripFiller drops filler data
+	StripAUD    bool
+	StripFiller bool
+
+	lengthSize int
+	sps        [][]byte
+	pps        [][]byte
+}
+
+// NewFilter creates a filter with the parameter sets and the nalu length
+// size of the AVCDecoderConfigurationRecord.
+func NewFilter(sps [][]byte, pps [][]byte, lengthSize int) *Filter {
+
+	return &Filter{
+		StripAUD:    true,
+		StripFiller: true,
+		lengthSize:  lengthSize,
+		sps:         copyNALUs(sps),
+		pps:         copyNALUs(pps),
+	}
+}
+
+// ParameterSets returns the latest known sps and pps.
+func (self *Filter) ParameterSets() (sps [][]byte, pps [][]byte) {
+	return self.sps, self.pps
+}
+
+// Filter splits an AVCC or Annex-B packet into its nal units. keyFrame marks
+// an access unit as random access point besides an IDR slice in it.
+func (self *Filter) Filter(data []byte, keyFrame bool) ([][]byte, error) {
+
+	nalus, err := self.split(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, 0, len(nalus)+2)
+	var sps, pps [][]byte
+	aud := false
+	idr := false
+
+	for _, nalu := range nalus {
+		if nalu[0]&0x80 != 0 {
+			return nil, fmt.Errorf("nalu type %d has the forbidden bit set", NALUType(nalu))
+		}
+
+		switch NALUType(nalu) {
+		case NALUTypeAUD:
+			if self.StripAUD || aud || len(out) > 0 {
+				continue
+			}
+			aud = true
+		case NALUTypeFiller:
+			if self.StripFiller {
+				continue
+			}
+		case NALUTypeSPS:
+			sps = appendUnique(sps, nalu)
+			continue
+		case NALUTypePPS:
+			pps = appendUnique(pps, nalu)
+			continue
+		case NALUTypeIDR:
+			idr = true
+		}
+		out = append(out, nalu)
+	}
+
+	// in-band parameter sets update the known ones
+	if len(sps) > 0 {
+		self.sps = copyNALUs(sps)
+	}
+	if len(pps) > 0 {
+		self.pps = copyNALUs(pps)
+	}
+
+	params := append(sps, pps...)
+	if keyFrame || idr {
+		params = append(copyNALUs(self.sps), self.pps...)
+	}
+	if len(params) == 0 {
+		return out, nil
+	}
+
+	// parameter sets go first, after the delimiter
+	head := 0
+	if aud {
+		head = 1
+	}
+	result := make([][]byte, 0, len(out)+len(params))
+	result = append(result, out[:head]...)
+	result = append(result, params...)
+	result = append(result, out[head:]...)
+	return result, nil
+}
+
+// split reads the packet as AVCC first, a length prefix of a nal unit of
+// 256-511 bytes looks like a 3 byte start code. Annex-B is only tried when
+// the packet does not parse as AVCC.
+func (self *Filter) split(data []byte) ([][]byte, error) {
+
+	if self.lengthSize == 0 && IsAnnexB(data) {
+		return SplitAnnexB(data), nil
+	}
+
+	nalus, err := SplitAVCC(data, self.lengthSize)
+	if err == nil && validNALUs(nalus) {
+		return nalus, nil
+	}
+	if IsAnnexB(data) {
+		return SplitAnnexB(data), nil
+	}
+	return nalus, err
+}
+
+// validNALUs tells if nal units have a valid header, AVCC lengths read from
+// Annex-B data give units with a zero or forbidden header.
+func validNALUs(nalus [][]byte) bool {
+
+	for _, nalu := range nalus {
+		if nalu[0]&0x80 != 0 || NALUType(nalu) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func appendUnique(nalus [][]byte, nalu []byte) [][]byte {
+
+	for _, n := range nalus {
+		if bytes.Equal(n, nalu) {
+			return nalus
+		}
+	}
+	return append(nalus, nalu)
+}
+
+func copyNALUs(nalus [][]byte) [][]byte {
+
+	out := make([][]byte, 0, len(nalus))
+	for _, nalu := range nalus {
+		if len(nalu) > 0 {
+			out = append(out, append([]byte(nil), nalu...))
+		}
+	}
+	return out
+}
@@ -0,0 +1,186 @@
+package bitstream
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func testNALU(header byte, size int) []byte {
+
+	nalu := make([]byte, size)
+	nalu[0] = header
+	for i := 1; i < size; i++ {
+		nalu[i] = byte(i%250 + 2)
+	}
+	return nalu
+}
+
+func TestFilterAVCCLengthLikeStartCode(t *testing.T) {
+
+	// a 300 byte slice has the length prefix 00 00 01 2c
+	for _, size := range []int{256, 300, 511} {
+		slice := testNALU(0x41, size)
+		data, err := JoinAVCC([][]byte{slice}, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsAnnexB(data) {
+			t.Fatalf("%d byte slice: length prefix % x is no start code", size, data[:4])
+		}
+
+		nalus, err := NewFilter([][]byte{testSPS}, [][]byte{testPPS}, 4).Filter(data, false)
+		if err != nil {
+			t.Fatalf("%d byte slice: %v", size, err)
+		}
+		if len(nalus) != 1 || !bytes.Equal(nalus[0], slice) {
+			t.Fatalf("%d byte slice: got %d nal units", size, len(nalus))
+		}
+	}
+}
+
+func TestFilterAnnexB(t *testing.T) {
+
+	idr := testNALU(0x65, 300)
+	data := JoinAnnexB([][]byte{{0x09, 0xf0}, testSPS, testPPS, idr})
+
+	nalus, err := NewFilter(nil, nil, 4).Filter(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{testSPS, testPPS, idr}
+	if len(nalus) != len(want) {
+		t.Fatalf("got %d nal units, want %d", len(nalus), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(nalus[i], want[i]) {
+			t.Fatalf("nal unit %d is type %d, want type %d", i, NALUType(nalus[i]), NALUType(want[i]))
+		}
+	}
+}
+
+func TestFilterKeyFrameParameterSets(t *testing.T) {
+
+	idr := testNALU(0x65, 40)
+	data, _ := JoinAVCC([][]byte{idr}, 4)
+
+	nalus, err := NewFilter([][]byte{testSPS}, [][]byte{testPPS}, 4).Filter(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nalus) != 3 || NALUType(nalus[0]) != NALUTypeSPS || NALUType(nalus[1]) != NALUTypePPS || !bytes.Equal(nalus[2], idr) {
+		t.Fatalf("keyframe is not sps, pps, idr: %d nal units", len(nalus))
+	}
+}
+
+func FuzzSplitAVCC(f *testing.F) {
+
+	f.Add([]byte{0, 0, 1, 0x2c, 0x41, 0x9a}, 4)
+	f.Add([]byte{0, 2, 0x65, 0x88, 0, 1, 0x41}, 2)
+	f.Add([]byte{3, 0x67, 0x42, 0xc0}, 1)
+
+	f.Fuzz(func(t *testing.T, data []byte, lengthSize int) {
+
+		nalus, err := SplitAVCC(data, lengthSize)
+		if err != nil {
+			return
+		}
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				t.Fatal("empty nal unit")
+			}
+		}
+
+		joined, err := JoinAVCC(nalus, lengthSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := SplitAVCC(joined, lengthSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != len(nalus) {
+			t.Fatalf("split of the join has %d nal units, want %d", len(again), len(nalus))
+		}
+		for i := range nalus {
+			if !bytes.Equal(again[i], nalus[i]) {
+				t.Fatalf("nal unit %d differs after the join", i)
+			}
+		}
+	})
+}
+
+func FuzzSplitAnnexB(f *testing.F) {
+
+	f.Add([]byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 1, 0x68, 0xce})
+	f.Add([]byte{0, 0, 1, 0x65, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{1, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		for _, nalu := range SplitAnnexB(data) {
+			if len(nalu) == 0 {
+				t.Fatal("empty nal unit")
+			}
+			if nalu[len(nalu)-1] == 0 {
+				t.Fatal("nal unit keeps a trailing zero")
+			}
+			if !bytes.Contains(data, nalu) {
+				t.Fatal("nal unit is not part of the data")
+			}
+		}
+	})
+}
+
+func FuzzFilter(f *testing.F) {
+
+	avcc, _ := JoinAVCC([][]byte{testNALU(0x41, 300)}, 4)
+	f.Add(avcc, false)
+	f.Add(JoinAnnexB([][]byte{testSPS, testPPS, testNALU(0x65, 20)}), true)
+	f.Add([]byte{0, 0, 1, 0x0c, 0xff}, false)
+
+	f.Fuzz(func(t *testing.T, data []byte, keyFrame bool) {
+
+		filter := NewFilter([][]byte{testSPS}, [][]byte{testPPS}, 4)
+		nalus, err := filter.Filter(data, keyFrame)
+		if err != nil {
+			return
+		}
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				t.Fatal("empty nal unit")
+			}
+			if typ := NALUType(nalu); typ == NALUTypeAUD || typ == NALUTypeFiller {
+				t.Fatalf("nal unit type %d is not stripped", typ)
+			}
+		}
+	})
+}
+
+func FuzzFilterAVCCSlice(f *testing.F) {
+
+	f.Add(testNALU(0x9a, 299)[1:])
+	f.Add(make([]byte, 255))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+
+		// any slice in AVCC framing comes out as it went in
+		slice := append([]byte{0x41}, payload...)
+		data, err := JoinAVCC([][]byte{slice}, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nalus, err := NewFilter([][]byte{testSPS}, [][]byte{testPPS}, 4).Filter(data, false)
+		if err != nil {
+			t.Fatalf("%d byte slice: %v", len(slice), err)
+		}
+		if len(nalus) != 1 || !bytes.Equal(nalus[0], slice) {
+			t.Fatalf("%d byte slice: got %d nal units", len(slice), len(nalus))
+		}
+	})
+}
@@ -0,0 +1,151 @@
+// Package bitstream converts h264 between the AVCC framing of rtmp/flv and
+// the Annex-B framing the rtp packetizers take.
+package bitstream
+
+import (
+	"fmt"
+)
+
+// NAL unit types the filter looks at.
+const (
+	NALUTypeSlice  = 1
+	NALUTypeIDR    = 5
+	NALUTypeSEI    = 6
+	NALUTypeSPS    = 7
+	NALUTypePPS    = 8
+	NALUTypeAUD    = 9
+	NALUTypeFiller = 12
+)
+
+var startCode = []byte{0, 0, 0, 1}
+
+// NALUType returns the type of a nal unit, 0 for an empty one.
+func NALUType(nalu []byte) int {
+
+	if len(nalu) == 0 {
+		return 0
+	}
+	return int(nalu[0] & 0x1f)
+}
+
+// IsAnnexB tells if data starts with a 3 or 4 byte start code.
+func IsAnnexB(data []byte) bool {
+
+	if len(data) >= 3 && data[0] == 0 && data[1] == 0 && data[2] == 1 {
+		return true
+	}
+	return len(data) >= 4 && data[0] == 0 && data[1] == 0 && data[2] == 0 && data[3] == 1
+}
+
+// SplitAnnexB splits at 3 and 4 byte start codes, empty nal units and the
+// trailing zero bytes of a unit are dropped.
+func SplitAnnexB(data []byte) [][]byte {
+
+	nalus := [][]byte{}
+	start := -1
+	zeros := 0
+
+	for i, b := range data {
+		if b == 1 && zeros >= 2 {
+			if start >= 0 {
+				nalus = appendNALU(nalus, data[start:i-zeros])
+			}
+			start = i + 1
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	if start >= 0 {
+		nalus = appendNALU(nalus, data[start:])
+	}
+	return nalus
+}
+
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// SplitAVCC splits length prefixed nal units, lengthSize is 1, 2 or 4. A
+// length running past the end of data is an error.
+func SplitAVCC(data []byte, lengthSize int) ([][]byte, error) {
+
+	if lengthSize != 1 && lengthSize != 2 && lengthSize != 4 {
+		return nil, fmt.Errorf("invalid avcc length size %d", lengthSize)
+	}
+
+	nalus := [][]byte{}
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, fmt.Errorf("avcc nalu length truncated, %d bytes left", len(data))
+		}
+
+		length := 0
+		for _, b := range data[:lengthSize] {
+			length = length<<8 | int(b)
+		}
+		data = data[lengthSize:]
+
+		if length > len(data) {
+			return nil, fmt.Errorf("avcc nalu length %d exceeds the %d bytes left", length, len(data))
+		}
+		if length > 0 {
+			nalus = append(nalus, data[:length])
+		}
+		data = data[length:]
+	}
+	return nalus, nil
+}
+
+// JoinAnnexB puts a 4 byte start code in front of every nal unit.
+func JoinAnnexB(nalus [][]byte) []byte {
+
+	size := 0
+	for _, nalu := range nalus {
+		size += len(startCode) + len(nalu)
+	}
+
+	out := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		out = append(out, startCode...)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// JoinAVCC prefixes every nal unit with its length.
+func JoinAVCC(nalus [][]byte, lengthSize int) ([]byte, error) {
+
+	if lengthSize != 1 && lengthSize != 2 && lengthSize != 4 {
+		return nil, fmt.Errorf("invalid avcc length size %d", lengthSize)
+	}
+
+	size := 0
+	for _, nalu := range nalus {
+		if len(nalu) >= 1<<(8*uint(lengthSize)) && lengthSize < 4 {
+			return nil, fmt.Errorf("nalu of %d bytes does not fit length size %d", len(nalu), lengthSize)
+		}
+		size += lengthSize + len(nalu)
+	}
+
+	out := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		for i := lengthSize - 1; i >= 0; i-- {
+			out = append(out, byte(len(nalu)>>(8*uint(i))))
+		}
+		out = append(out, nalu...)
+	}
+	return out, nil
+}
@@ -10,10 +10,11 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	rtcrtmp "github.com/notedit/rtc-rtmp"
+	"github.com/notedit/rtc-rtmp/signaling"
 	"github.com/notedit/rtmp-lib"
 	"github.com/notedit/rtmp-lib/av"
 	"github.com/notedit/rtmp-lib/pubsub"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v3"
 )
 
 type Channel struct {
@@ -221,6 +222,16 @@ func main() {
 	router.GET("/", index)
 	router.POST("/rtc/v1/play", pullstream)
 
+	whep := rtcrtmp.NewWHEPHandler("/whep/", endpoint, func(stream string) string {
+		return "rtmp://localhost/" + stream
+	})
+	router.Any("/whep/*stream", gin.WrapH(whep))
+
+	signal := signaling.NewServer(endpoint, func(stream string) string {
+		return "rtmp://localhost/" + stream
+	})
+	router.GET("/rtc/v1/ws", gin.WrapH(signal))
+
 	go startRtmp()
 
 	router.Run(":8000")
@@ -10,7 +10,7 @@ import (
 	"github.com/notedit/rtmp-lib"
 	"github.com/notedit/rtmp-lib/av"
 	"github.com/notedit/rtmp-lib/pubsub"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v3"
 )
 
 type Channel struct {
@@ -19,9 +19,9 @@ type Channel struct {
 
 var channels = map[string]*Channel{}
 
-func startRtmp() {
+var l = &sync.RWMutex{}
 
-	l := &sync.RWMutex{}
+func startRtmp() {
 
 	config := &rtmp.Config{
 		BufferSize:1024,
@@ -161,6 +161,40 @@ func pullstream(c *gin.Context) {
 	
 }
 
+// whipChannel lets a WHIP publisher write the channel queue, rtmp players of
+// the same path read it like a rtmp publish
+type whipChannel struct {
+	*pubsub.Queue
+	path string
+}
+
+func (self *whipChannel) Close() error {
+	l.Lock()
+	delete(channels, self.path)
+	l.Unlock()
+	return self.Queue.Close()
+}
+
+func whipPublish(stream string) (rtcrtmp.PacketWriter, error) {
+
+	path := "/" + stream
+
+	l.Lock()
+	defer l.Unlock()
+
+	if channels[path] != nil {
+		return nil, fmt.Errorf("stream %s is publishing", path)
+	}
+
+	ch := &Channel{}
+	ch.que = pubsub.NewQueue()
+	channels[path] = ch
+
+	fmt.Println("whip publish ", path)
+
+	return &whipChannel{ch.que, path}, nil
+}
+
 func main() {
 
 	go startRtmp()
@@ -176,6 +210,9 @@ func main() {
 	router.GET("/", index)
 	router.POST("/rtc/v1/play", pullstream)
 
+	whip := rtcrtmp.NewWHIPHandler("/whip/", "", whipPublish)
+	router.Any("/whip/*stream", gin.WrapH(whip))
+
 	router.Run(":8000")
 
 }
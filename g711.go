@@ -0,0 +1,96 @@
+package rtcrtmp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// g711Packet is the duration of the g711 packets the router sends, 160 samples
+const g711Packet = 20 * time.Millisecond
+
+// newG711Variant prepares the transcoding of the source audio to one G.711
+// law, the transformer is set up for the first subscriber.
+func newG711Variant(encoding audioEncoding, ssrc uint32, source av.AudioCodecData, config Config) *audioVariant {
+
+	encoder := trans.PCMU
+	if encoding == audioPCMA {
+		encoder = trans.PCMA
+	}
+
+	setup := func() (*trans.Transformer, error) {
+
+		transform := &trans.Transformer{}
+		if err := transform.SetLoudnessConfig(config.Loudness); err != nil {
+			return nil, err
+		}
+		if err := transform.SetInCodecData(source); err != nil {
+			return nil, err
+		}
+		if err := transform.SetG711Out(encoder); err != nil {
+			return nil, err
+		}
+		if err := transform.Setup(); err != nil {
+			return nil, fmt.Errorf("%s transcoding: %v", encoding, err)
+		}
+		return transform, nil
+	}
+
+	return newAudioVariant(encoding, ssrc, setup, newG711Codec(encoding), &codecs.G711Payloader{})
+}
+
+// newG711Codec is the codec of one G.711 law with its static payload type.
+func newG711Codec(encoding audioEncoding) webrtc.RTPCodecParameters {
+
+	codec := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: trans.G711SampleRate, Channels: 1},
+		PayloadType:        webrtc.PayloadType(PCMUPayloadType),
+	}
+	if encoding == audioPCMA {
+		codec.MimeType = webrtc.MimeTypePCMA
+		codec.PayloadType = webrtc.PayloadType(PCMAPayloadType)
+	}
+	return codec
+}
+
+// cut packetizes the encoded samples in 20ms packets. A gap or a step back
+// drops the pending samples, they would stretch the timeline.
+func (self *audioVariant) cut(pkts []av.Packet) ([][]*rtp.Packet, []time.Duration) {
+
+	samples := int(int64(g711Packet) * trans.G711SampleRate / int64(time.Second))
+
+	var out [][]*rtp.Packet
+	var times []time.Duration
+	for _, pkt := range pkts {
+		end := self.pendingTime + g711Time(len(self.pending))
+		if len(self.pending) == 0 || pkt.Time > end+g711Packet || pkt.Time < self.pendingTime {
+			self.pending = self.pending[:0]
+			self.pendingTime = pkt.Time
+		}
+		self.pending = append(self.pending, pkt.Data...)
+
+		for len(self.pending) >= samples {
+			packets := self.packetizer.Packetize(self.pending[:samples], uint32(samples))
+			self.stamp(packets, self.pendingTime)
+			out = append(out, packets)
+			times = append(times, self.pendingTime)
+
+			self.pending = append(self.pending[:0], self.pending[samples:]...)
+			self.pendingTime += g711Packet
+		}
+	}
+	return out, times
+}
+
+func g711Time(samples int) time.Duration {
+	return time.Duration(samples) * time.Second / trans.G711SampleRate
+}
+
+func g711RTPTime(t time.Duration) uint32 {
+	return uint32(int64(t) * trans.G711SampleRate / int64(time.Second))
+}
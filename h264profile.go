@@ -0,0 +1,213 @@
+package rtcrtmp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// defaultProfileLevelID is advertised until a video source is known,
+// constrained baseline level 3.1.
+var defaultProfileLevelID = profileLevelID{profileIdc: 0x42, profileIop: 0xe0, levelIdc: 0x1f}
+
+type h264Profile int
+
+const (
+	profileOther h264Profile = iota
+	profileConstrainedBaseline
+	profileBaseline
+	profileMain
+	profileExtended
+	profileHigh
+	profileConstrainedHigh
+)
+
+// profileLevelID is the profile-level-id of RFC 6184, profile_idc,
+// constraint flags and level_idc as they appear in the sps.
+type profileLevelID struct {
+	profileIdc uint8
+	profileIop uint8
+	levelIdc   uint8
+}
+
+// spsProfileLevelID reads the profile-level-id from an sps nalu.
+func spsProfileLevelID(sps []byte) (profileLevelID, error) {
+
+	if len(sps) < 4 || sps[0]&0x1f != naluTypeSPS {
+		return profileLevelID{}, fmt.Errorf("invalid h264 sps")
+	}
+	return profileLevelID{profileIdc: sps[1], profileIop: sps[2], levelIdc: sps[3]}, nil
+}
+
+func parseProfileLevelID(s string) (profileLevelID, error) {
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 3 {
+		return profileLevelID{}, fmt.Errorf("invalid profile-level-id %q", s)
+	}
+	return profileLevelID{profileIdc: b[0], profileIop: b[1], levelIdc: b[2]}, nil
+}
+
+func (self profileLevelID) String() string {
+	return fmt.Sprintf("%02x%02x%02x", self.profileIdc, self.profileIop, self.levelIdc)
+}
+
+// profile classifies the profile like RFC 6184 table 5, constrained
+// baseline can be signalled by baseline, main and extended.
+func (self profileLevelID) profile() h264Profile {
+
+	switch self.profileIdc {
+	case 0x42:
+		if self.profileIop&0x40 != 0 {
+			return profileConstrainedBaseline
+		}
+		return profileBaseline
+	case 0x4d:
+		if self.profileIop&0x80 != 0 {
+			return profileConstrainedBaseline
+		}
+		return profileMain
+	case 0x58:
+		if self.profileIop&0xc0 == 0xc0 {
+			return profileConstrainedBaseline
+		}
+		return profileExtended
+	case 0x64:
+		if self.profileIop&0x0c == 0x0c {
+			return profileConstrainedHigh
+		}
+		return profileHigh
+	}
+	return profileOther
+}
+
+// decodes tells if a decoder of this profile can play a stream of the other.
+// The level only matters when the receiver does not allow level asymmetry.
+func (self profileLevelID) decodes(stream profileLevelID, levelAsymmetry bool) bool {
+
+	if !levelAsymmetry && stream.levelIdc > self.levelIdc {
+		return false
+	}
+
+	receiver := self.profile()
+	switch stream.profile() {
+	case profileOther:
+		return self.profileIdc == stream.profileIdc
+	case profileConstrainedBaseline:
+		return receiver != profileOther
+	case profileMain:
+		return receiver == profileMain || receiver == profileHigh
+	case profileConstrainedHigh:
+		return receiver == profileConstrainedHigh || receiver == profileHigh
+	default:
+		return receiver == stream.profile()
+	}
+}
+
+// h264FmtpLine is the fmtp of the h264 codec for a stream of profile,
+// packetizationMode is "1" unless a subscriber only takes single nal units.
+func h264FmtpLine(profile profileLevelID, packetizationMode string) string {
+	return "level-asymmetry-allowed=1;packetization-mode=" + packetizationMode + ";profile-level-id=" + profile.String()
+}
+
+// newH264Codec is the h264 codec of the transports.
+func newH264Codec(payloadType uint8, fmtp string, rtcpfb []webrtc.RTCPFeedback) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: rtcpfb},
+		PayloadType:        webrtc.PayloadType(payloadType),
+	}
+}
+
+func packetizationMode(singleNAL bool) string {
+	if singleNAL {
+		return "0"
+	}
+	return "1"
+}
+
+// h264Fmtp holds the h264 parameters of an fmtp line.
+type h264Fmtp struct {
+	profile           profileLevelID
+	packetizationMode string
+	levelAsymmetry    bool
+}
+
+func parseH264Fmtp(fmtp string) (h264Fmtp, error) {
+
+	params := map[string]string{}
+	for _, param := range strings.Split(fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	// without profile-level-id the receiver supports baseline level 1
+	parsed := h264Fmtp{
+		profile:           profileLevelID{profileIdc: 0x42, levelIdc: 0x0a},
+		packetizationMode: params["packetization-mode"],
+		levelAsymmetry:    params["level-asymmetry-allowed"] == "1",
+	}
+	if parsed.packetizationMode == "" {
+		parsed.packetizationMode = "0"
+	}
+
+	if id, ok := params["profile-level-id"]; ok {
+		profile, err := parseProfileLevelID(id)
+		if err != nil {
+			return h264Fmtp{}, err
+		}
+		parsed.profile = profile
+	}
+	return parsed, nil
+}
+
+// h264Compatible tells if a remote h264 fmtp can receive a stream of profile.
+// FU-A needs packetization-mode 1, mode 0 is accepted with singleNAL.
+func h264Compatible(fmtp string, profile profileLevelID, singleNAL bool) bool {
+
+	remote, err := parseH264Fmtp(fmtp)
+	if err != nil {
+		return false
+	}
+
+	if remote.packetizationMode != "1" && !(singleNAL && remote.packetizationMode == "0") {
+		return false
+	}
+	return remote.profile.decodes(profile, remote.levelAsymmetry)
+}
+
+// checkH264Profile rejects a remote description whose video sections offer
+// no h264 format able to decode a stream of profile.
+func checkH264Profile(sdpstr string, sdpType webrtc.SDPType, profile profileLevelID, singleNAL bool) error {
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(sdpstr)); err != nil {
+		return err
+	}
+
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute("inactive"); ok {
+			continue
+		}
+
+		compatible := false
+		for _, format := range mediaFormats(media) {
+			if format.name == h264Name && h264Compatible(format.fmtp, profile, singleNAL) {
+				compatible = true
+				break
+			}
+		}
+
+		if !compatible {
+			return fmt.Errorf("%s has no h264 format compatible with profile-level-id %s", sdpType, profile)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package rtcrtmp
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSPSProfileLevelID(t *testing.T) {
+
+	for _, test := range []struct {
+		sps  []byte
+		want string
+		ok   bool
+	}{
+		{[]byte{0x67, 0x42, 0xc0, 0x1f, 0xda}, "42c01f", true},
+		{[]byte{0x27, 0x64, 0x00, 0x28}, "640028", true},
+		{[]byte{0x67, 0x42, 0xc0}, "", false},
+		{[]byte{0x68, 0xce, 0x3c, 0x80}, "", false},
+	} {
+		id, err := spsProfileLevelID(test.sps)
+		if (err == nil) != test.ok {
+			t.Fatalf("sps % x: error %v", test.sps, err)
+		}
+		if test.ok && id.String() != test.want {
+			t.Fatalf("sps % x: profile-level-id %s, want %s", test.sps, id, test.want)
+		}
+	}
+}
+
+func TestH264Compatible(t *testing.T) {
+
+	for _, test := range []struct {
+		fmtp      string
+		stream    string
+		singleNAL bool
+		want      bool
+	}{
+		// the same profile and level
+		{"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", "42e01f", false, true},
+		// packetization-mode 0 only for single nal subscribers
+		{"packetization-mode=0;profile-level-id=42e01f", "42e01f", false, false},
+		{"packetization-mode=0;profile-level-id=42e01f", "42e01f", true, true},
+		{"profile-level-id=42e01f", "42e01f", true, true},
+		{"packetization-mode=2;profile-level-id=42e01f", "42e01f", true, false},
+		// a higher level needs level asymmetry
+		{"packetization-mode=1;profile-level-id=42e01f", "42e028", false, false},
+		{"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", "42e028", false, true},
+		// constrained baseline plays on every known profile
+		{"packetization-mode=1;profile-level-id=42001f", "42e01f", false, true},
+		{"packetization-mode=1;profile-level-id=4d001f", "42e01f", false, true},
+		{"packetization-mode=1;profile-level-id=640c1f", "4de01f", false, true},
+		// main needs main or high
+		{"packetization-mode=1;profile-level-id=42e01f", "4d001f", false, false},
+		{"packetization-mode=1;profile-level-id=64001f", "4d001f", false, true},
+		// constrained high needs constrained high or high
+		{"packetization-mode=1;profile-level-id=640c1f", "640c1f", false, true},
+		{"packetization-mode=1;profile-level-id=4d001f", "640c1f", false, false},
+		// high needs high
+		{"packetization-mode=1;profile-level-id=640c1f", "64001f", false, false},
+		{"packetization-mode=1;profile-level-id=64001f", "64001f", false, true},
+		// other profiles only match themselves
+		{"packetization-mode=1;profile-level-id=f4001f", "f4001f", false, true},
+		{"packetization-mode=1;profile-level-id=64001f", "f4001f", false, false},
+		// without profile-level-id the receiver is baseline level 1
+		{"packetization-mode=1", "42e00a", false, true},
+		{"packetization-mode=1", "42e01f", false, false},
+		{"packetization-mode=1;profile-level-id=zz", "42e01f", false, false},
+	} {
+		stream, err := parseProfileLevelID(test.stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h264Compatible(test.fmtp, stream, test.singleNAL); got != test.want {
+			t.Fatalf("%q with a %s stream, single nal %v: %v, want %v", test.fmtp, test.stream, test.singleNAL, got, test.want)
+		}
+	}
+}
+
+func TestCheckH264Profile(t *testing.T) {
+
+	profile := profileLevelID{profileIdc: 0x64, profileIop: 0x00, levelIdc: 0x1f}
+
+	for _, test := range []struct {
+		video string
+		ok    bool
+	}{
+		{"m=video 9 UDP/TLS/RTP/SAVPF 102 106\r\n" +
+			"a=rtpmap:102 H264/90000\r\na=fmtp:102 packetization-mode=1;profile-level-id=42e01f\r\n" +
+			"a=rtpmap:106 H264/90000\r\na=fmtp:106 packetization-mode=1;profile-level-id=64001f\r\n", true},
+		{"m=video 9 UDP/TLS/RTP/SAVPF 102\r\n" +
+			"a=rtpmap:102 H264/90000\r\na=fmtp:102 packetization-mode=1;profile-level-id=42e01f\r\n", false},
+		{"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 VP8/90000\r\n", false},
+		// rejected and inactive sections need no format
+		{"m=video 0 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 VP8/90000\r\n", true},
+		{"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=inactive\r\na=rtpmap:96 VP8/90000\r\n", true},
+	} {
+		err := checkH264Profile(testSDP(test.video), webrtc.SDPTypeOffer, profile, false)
+		if (err == nil) != test.ok {
+			t.Fatalf("%q: %v", test.video, err)
+		}
+	}
+}
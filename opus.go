@@ -0,0 +1,65 @@
+package rtcrtmp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// opusDuration reads the duration of an opus packet from its toc byte.
+// Invalid packets count as one 20ms frame.
+func opusDuration(packet []byte) time.Duration {
+
+	duration, err := trans.OpusPacketDuration(packet)
+	if err != nil {
+		return 20 * time.Millisecond
+	}
+	return duration
+}
+
+// opusSamples is the rtp timestamp step of an opus packet at 48kHz.
+func opusSamples(packet []byte) uint32 {
+	return audioRTPTime(opusDuration(packet))
+}
+
+// newOpusCodec is the stereo opus codec of the transports.
+func newOpusCodec(payloadType uint8, fmtp string) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: fmtp},
+		PayloadType:        webrtc.PayloadType(payloadType),
+	}
+}
+
+// newMultiopusCodec is the codec chrome decodes opus multistream with.
+func newMultiopusCodec(payloadType uint8, channels uint16, fmtp string) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeMultiopus, ClockRate: 48000, Channels: channels, SDPFmtpLine: fmtp},
+		PayloadType:        webrtc.PayloadType(payloadType),
+	}
+}
+
+// newMultiopusVariant prepares the transcoding of a source of more than two
+// channels to opus multistream, it keeps the source channel layout.
+func newMultiopusVariant(ssrc uint32, source av.AudioCodecData, config Config) (*audioVariant, error) {
+
+	mapping, ok := trans.OpusSurroundMapping(source.ChannelLayout().Count())
+	if !ok {
+		return nil, fmt.Errorf("no opus multistream mapping for %s", source.ChannelLayout())
+	}
+
+	setup := func() (*trans.Transformer, error) {
+
+		transform := &trans.Transformer{}
+		if err := setupMultiopusTransform(transform, source, config); err != nil {
+			return nil, fmt.Errorf("multiopus transcoding: %v", err)
+		}
+		return transform, nil
+	}
+
+	codec := newMultiopusCodec(MultiopusPayloadType, uint16(len(mapping.Mapping)), config.Opus.MultiopusFmtpLine(mapping))
+	return newAudioVariant(audioMultiopus, ssrc, setup, codec, &codecs.OpusPayloader{}), nil
+}
@@ -0,0 +1,160 @@
+package rtcrtmp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// mediaFormat is one payload type of an sdp media section.
+type mediaFormat struct {
+	payloadType uint8
+	name        string
+	channels    int
+	fmtp        string
+}
+
+// mediaFormats lists the payload types of the section in the order of the
+// m-line, which is the preference of the remote side. Names are upper case.
+func mediaFormats(media *sdp.MediaDescription) []mediaFormat {
+
+	names := map[string]string{}
+	channels := map[string]int{}
+	fmtps := map[string]string{}
+	for _, attr := range media.Attributes {
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch attr.Key {
+		case "rtpmap":
+			// name/clock rate/channels
+			encoding := strings.Split(parts[1], "/")
+			names[parts[0]] = strings.ToUpper(encoding[0])
+			if len(encoding) > 2 {
+				channels[parts[0]], _ = strconv.Atoi(encoding[2])
+			}
+		case "fmtp":
+			fmtps[parts[0]] = parts[1]
+		}
+	}
+
+	formats := []mediaFormat{}
+	for _, format := range media.MediaName.Formats {
+		pt, err := strconv.Atoi(format)
+		if err != nil || pt < 0 || pt > 127 {
+			continue
+		}
+		formats = append(formats, mediaFormat{
+			payloadType: uint8(pt),
+			name:        names[format],
+			channels:    channels[format],
+			fmtp:        fmtps[format],
+		})
+	}
+	return formats
+}
+
+// offeredFormats picks the audio and the h264 format of an offer for a stream
+// of profile. Audio is the first of opus, PCMU and PCMA in the order of the
+// offer. Packetization-mode 1 goes before mode 0 and the same h264 profile
+// before any other compatible one. The first section of each kind decides,
+// an empty name means the offer has no such format.
+func offeredFormats(sdpstr string, profile profileLevelID) (audio mediaFormat, h264 mediaFormat) {
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(sdpstr)); err != nil {
+		return
+	}
+
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		formats := mediaFormats(media)
+
+		if media.MediaName.Media == "audio" && audio.name == "" {
+			for _, format := range formats {
+				if format.name == opusName || format.name == pcmuName || format.name == pcmaName {
+					audio = format
+					break
+				}
+			}
+		}
+
+		if media.MediaName.Media == "video" && h264.name == "" {
+			best := -1
+			for _, format := range formats {
+				if format.name != h264Name || !h264Compatible(format.fmtp, profile, true) {
+					continue
+				}
+				remote, _ := parseH264Fmtp(format.fmtp)
+				score := 0
+				if remote.packetizationMode == "1" {
+					score += 2
+				}
+				if remote.profile.profile() == profile.profile() {
+					score++
+				}
+				if score > best {
+					best = score
+					h264 = format
+				}
+			}
+		}
+	}
+	return
+}
+
+// offeredAudio finds the format of name and channels in the first audio
+// section of an offer, an empty name means there is none.
+func offeredAudio(sdpstr string, name string, channels int) (format mediaFormat) {
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(sdpstr)); err != nil {
+		return
+	}
+
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != "audio" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, f := range mediaFormats(media) {
+			if f.name == name && f.channels == channels {
+				return f
+			}
+		}
+		return
+	}
+	return
+}
+
+// remoteCodecNames collects the encoding names the sections of kind carry.
+func remoteCodecNames(sdpstr string, kind webrtc.RTPCodecType) map[string]bool {
+
+	names := map[string]bool{}
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(sdpstr)); err != nil {
+		return names
+	}
+
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != kind.String() {
+			continue
+		}
+		for _, format := range mediaFormats(media) {
+			names[format.name] = true
+		}
+	}
+	return names
+}
+
+// encodingName is the rtpmap encoding name of a codec in upper case.
+func encodingName(codec webrtc.RTPCodecParameters) string {
+
+	parts := strings.SplitN(codec.MimeType, "/", 2)
+	return strings.ToUpper(parts[len(parts)-1])
+}
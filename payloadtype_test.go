@@ -0,0 +1,189 @@
+package rtcrtmp
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// testSDP puts media sections into a session description.
+func testSDP(sections ...string) string {
+
+	sdpstr := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	for _, section := range sections {
+		sdpstr += section
+	}
+	return sdpstr
+}
+
+func TestOfferedFormats(t *testing.T) {
+
+	constrainedBaseline := profileLevelID{profileIdc: 0x42, profileIop: 0xe0, levelIdc: 0x1f}
+	main := profileLevelID{profileIdc: 0x4d, profileIop: 0x00, levelIdc: 0x1f}
+
+	h264 := "m=video 9 UDP/TLS/RTP/SAVPF 96 98 100\r\n" +
+		"a=rtpmap:96 H264/90000\r\na=fmtp:96 packetization-mode=0;profile-level-id=42e01f\r\n" +
+		"a=rtpmap:98 H264/90000\r\na=fmtp:98 packetization-mode=1;profile-level-id=42e01f\r\n" +
+		"a=rtpmap:100 H264/90000\r\na=fmtp:100 packetization-mode=1;profile-level-id=4d001f\r\n"
+
+	for _, test := range []struct {
+		name    string
+		offer   string
+		profile profileLevelID
+		audio   string
+		audioPT uint8
+		videoPT uint8
+	}{
+		{"opus", testSDP("m=audio 9 UDP/TLS/RTP/SAVPF 109 0 8\r\na=rtpmap:109 opus/48000/2\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\n"),
+			constrainedBaseline, opusName, 109, 0},
+		{"first of the m-line", testSDP("m=audio 9 UDP/TLS/RTP/SAVPF 8 0 111\r\na=rtpmap:8 PCMA/8000\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:111 opus/48000/2\r\n"),
+			constrainedBaseline, pcmaName, 8, 0},
+		{"unknown audio skipped", testSDP("m=audio 9 UDP/TLS/RTP/SAVPF 9 0\r\na=rtpmap:9 G722/8000\r\na=rtpmap:0 PCMU/8000\r\n"),
+			constrainedBaseline, pcmuName, 0, 0},
+		{"rejected audio", testSDP("m=audio 0 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\n"),
+			constrainedBaseline, "", 0, 0},
+		{"same profile in mode 1", testSDP(h264), constrainedBaseline, "", 0, 98},
+		{"main profile", testSDP(h264), main, "", 0, 100},
+		{"mode 0 only", testSDP("m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 H264/90000\r\na=fmtp:96 packetization-mode=0;profile-level-id=42e01f\r\n"),
+			constrainedBaseline, "", 0, 96},
+		{"no h264", testSDP("m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 VP8/90000\r\n"), constrainedBaseline, "", 0, 0},
+	} {
+		audio, video := offeredFormats(test.offer, test.profile)
+		if audio.name != test.audio || audio.payloadType != test.audioPT {
+			t.Fatalf("%s: audio %s %d, want %s %d", test.name, audio.name, audio.payloadType, test.audio, test.audioPT)
+		}
+		if video.payloadType != test.videoPT || (test.videoPT != 0) != (video.name == h264Name) {
+			t.Fatalf("%s: h264 %q %d, want %d", test.name, video.name, video.payloadType, test.videoPT)
+		}
+	}
+}
+
+func TestOfferedAudio(t *testing.T) {
+
+	offer := testSDP("m=audio 9 UDP/TLS/RTP/SAVPF 111 112 113\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\na=rtpmap:112 multiopus/48000/6\r\na=rtpmap:113 multiopus/48000/8\r\n")
+
+	for _, test := range []struct {
+		channels int
+		pt       uint8
+	}{
+		{6, 112},
+		{8, 113},
+		{4, 0},
+	} {
+		format := offeredAudio(offer, multiopus, test.channels)
+		if format.payloadType != test.pt || (test.pt != 0) != (format.name == multiopus) {
+			t.Fatalf("%d channels: %q %d, want %d", test.channels, format.name, format.payloadType, test.pt)
+		}
+	}
+}
+
+func TestTransportFollowsPayloadTypes(t *testing.T) {
+
+	router := &RTCRouter{streamURL: "rtmp://localhost/live/test", audioSSRC: 1000}
+
+	transport, err := NewRTCTransport("payloadtype", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Stop()
+	if err = transport.addStream(router, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// opus on 109 like firefox
+	m := &webrtc.MediaEngine{}
+	err = m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        109,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = transport.SetRemoteSDP(offer.SDP, webrtc.SDPTypeOffer); err != nil {
+		t.Fatal(err)
+	}
+
+	transport.RLock()
+	track := transport.tracks[router.audioSSRC]
+	transport.RUnlock()
+
+	out := track.rewrite(&rtp.Packet{Header: rtp.Header{SSRC: router.audioSSRC, PayloadType: OpusPayloadType}, Payload: []byte{0xf8, 0xff, 0xfe}})
+	if out.PayloadType != 109 || out.SSRC != track.ssrc {
+		t.Fatalf("router packet goes out with payload type %d ssrc %d", out.PayloadType, out.SSRC)
+	}
+}
+
+func TestTransportSwitchFollowsEncoding(t *testing.T) {
+
+	from := &RTCRouter{streamURL: "rtmp://localhost/live/g711", audioSSRC: 1000,
+		audioVariants: []*audioVariant{{encoding: audioPCMU, ssrc: 1001}}}
+	to := &RTCRouter{streamURL: "rtmp://localhost/live/opus", audioSSRC: 2000}
+
+	transport, err := NewRTCTransport("switchencoding", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Stop()
+	if err = transport.addStream(from, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// PCMU first, opus on 109
+	m := &webrtc.MediaEngine{}
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: 109},
+	} {
+		if err = m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = transport.SetRemoteSDP(offer.SDP, webrtc.SDPTypeOffer); err != nil {
+		t.Fatal(err)
+	}
+
+	transport.RLock()
+	track := transport.tracks[from.audioSSRC]
+	transport.RUnlock()
+	if track.encoding != audioPCMU {
+		t.Fatalf("negotiated %s, want PCMU", track.encoding)
+	}
+
+	// the new router has no PCMU variant, the track falls back to opus
+	if err = transport.switchStream(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if track.encoding != audioOpus {
+		t.Fatalf("switched track sends %s, want opus", track.encoding)
+	}
+	out := track.rewrite(&rtp.Packet{Header: rtp.Header{SSRC: to.audioSSRC, PayloadType: OpusPayloadType}, Payload: []byte{0xf8, 0xff, 0xfe}})
+	if out.PayloadType != 109 {
+		t.Fatalf("opus goes out with payload type %d", out.PayloadType)
+	}
+}
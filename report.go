@@ -0,0 +1,117 @@
+package rtcrtmp
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/rs/zerolog/log"
+)
+
+const senderReportInterval = time.Second
+
+// syncPoint ties a router rtp timestamp to the wall clock time of its media,
+// audio and video of a router share the same rtmp timeline.
+type syncPoint struct {
+	rtpTime uint32
+	wall    time.Time
+}
+
+// ntpTime converts to the 64 bit ntp format of sender reports.
+func ntpTime(t time.Time) uint64 {
+
+	// seconds between 1900 and 1970
+	const ntpEpochOffset = 2208988800
+
+	nanos := uint64(t.UnixNano())
+	seconds := nanos/1e9 + ntpEpochOffset
+	fraction := (nanos % 1e9) << 32 / 1e9
+	return seconds<<32 | fraction
+}
+
+// sendReports sends a sender report for every started track until the
+// transport stops.
+func (self *RTCTransport) sendReports() {
+
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+
+	type reportTrack struct {
+		track  *rtcTrack
+		router *RTCRouter
+	}
+
+	for range ticker.C {
+		self.RLock()
+		if self.stop {
+			self.RUnlock()
+			return
+		}
+		connected := self.connected
+		tracks := []reportTrack{}
+		for _, stream := range self.streams {
+			for _, track := range stream.tracks() {
+				tracks = append(tracks, reportTrack{track: track, router: stream.router})
+			}
+		}
+		self.RUnlock()
+
+		if !connected {
+			continue
+		}
+
+		// routers lock before transports and tracks, so none is held here
+		now := time.Now()
+		reports := []rtcp.Packet{}
+		for _, t := range tracks {
+			source, started := t.track.reportSource()
+			if !started {
+				continue
+			}
+			sync, ok := t.router.syncPoint(source)
+			if !ok {
+				continue
+			}
+			if report := t.track.senderReport(source, sync, now); report != nil {
+				reports = append(reports, report)
+			}
+		}
+
+		if len(reports) == 0 {
+			continue
+		}
+
+		if err := self.pc.WriteRTCP(reports); err != nil {
+			log.Debug().Msgf("transport %s write sender report error %v", self.id, err)
+		}
+	}
+}
+
+// reportSource returns the router ssrc the track forwards, false before the
+// first packet.
+func (self *rtcTrack) reportSource() (uint32, bool) {
+
+	self.Lock()
+	defer self.Unlock()
+	return self.source, self.started
+}
+
+// senderReport maps now to the track's rtp clock through the sync point of
+// source, nil when the track moved to another source meanwhile.
+func (self *rtcTrack) senderReport(source uint32, sync syncPoint, now time.Time) *rtcp.SenderReport {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.source != source {
+		return nil
+	}
+
+	elapsed := now.Sub(sync.wall).Seconds() * float64(self.clockRate())
+	return &rtcp.SenderReport{
+		SSRC:        self.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     sync.rtpTime + self.tsOffset + uint32(int64(elapsed)),
+		PacketCount: self.packetCount,
+		OctetCount:  self.octetCount,
+	}
+}
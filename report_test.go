@@ -0,0 +1,23 @@
+package rtcrtmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNTPTime(t *testing.T) {
+
+	for _, test := range []struct {
+		time time.Time
+		want uint64
+	}{
+		{time.Unix(0, 0), 2208988800 << 32},
+		{time.Unix(0, 500000000), 2208988800<<32 | 0x80000000},
+		{time.Unix(1, 250000000), 2208988801<<32 | 0x40000000},
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 3786825600 << 32},
+	} {
+		if got := ntpTime(test.time); got != test.want {
+			t.Fatalf("%v: %#x, want %#x", test.time, got, test.want)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package rtcrtmp
 
 import (
-	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"github.com/notedit/rtc-rtmp/bitstream"
 	"github.com/notedit/rtc-rtmp/trans"
 	"github.com/notedit/rtmp-lib"
-	"github.com/notedit/rtmp-lib/aac"
 	"github.com/notedit/rtmp-lib/av"
 	"github.com/notedit/rtmp-lib/h264"
 	"github.com/pion/rtp"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
 	uuid "github.com/satori/go.uuid"
 	"net/url"
 	"strings"
@@ -18,11 +21,11 @@ import (
 )
 
 const (
-	DefaultOpusSSRC = 111111111
-	DefaultH264SSRC = 333333333
-
-	OpusPayloadType = 111
-	H264PayloadTYpe = 127
+	OpusPayloadType      = 111
+	MultiopusPayloadType = 112
+	H264PayloadTYpe      = 127
+	PCMUPayloadType      = 0
+	PCMAPayloadType      = 8
 )
 
 
@@ -32,18 +35,65 @@ type RTCRouter struct {
 	streamID   string
 	streamURL  string
 	streams    []av.CodecData
-	videoCodec h264.CodecData
-	audioCodec aac.CodecData
-	conn       *rtmp.Conn
+	// nil when the source has no such stream
+	videoCodec *h264.CodecData
+	audioCodec av.AudioCodecData
+	profile    profileLevelID
+	filter     *bitstream.Filter
+	// opus fmtp matching the encoder config
+	opusFmtp string
+	conn     *rtmp.Conn
 
 	transform     *trans.Transformer
 	lastVideoTime time.Duration
 	lastAudioTime time.Duration
 
+	// audio rtp timestamps follow the transformer packet times, audioBase is
+	// the rtp timestamp of rtmp time zero
+	audioBase     uint32
+	audioNext     time.Duration
+	audioDuration time.Duration
+	audioStarted  bool
+
+	// wall clock time of rtmp time zero, sender reports map the rtp clock
+	// of every router ssrc through its last sync point
+	epoch time.Time
+	syncs map[uint32]syncPoint
+
+	videoSSRC       uint32
+	audioSSRC       uint32
 	videoPacketizer rtp.Packetizer
 	audioPacketizer rtp.Packetizer
 
+	// packetization-mode 0 variant of the video, only produced while a
+	// subscriber negotiated it
+	singleNALSSRC       uint32
+	singleNALPacketizer rtp.Packetizer
+
+	// encodings of the audio besides stereo opus for the subscribers that
+	// negotiated them, empty without a source audio
+	audioVariants []*audioVariant
+	// codec of the multiopus variant, nil without one
+	multiopus *webrtc.RTPCodecParameters
+
 	outTransports map[string]*RTCTransport
+	// subscribers of each media kind, nobody wanting audio skips transcoding.
+	// audioTransports are the stereo opus ones, the other encodings keep
+	// theirs in the variant.
+	audioTransports map[string]*RTCTransport
+	videoTransports map[string]*RTCTransport
+	// video subscribers of the packetization-mode 0 variant
+	singleNALTransports map[string]*RTCTransport
+
+	// video rtp timestamps follow the presentation time, videoBase is the
+	// rtp timestamp of rtmp time zero
+	videoBase    uint32
+	videoStarted bool
+
+	bframePolicy BFramePolicy
+	bframes      bool
+	// why the router stopped on its own
+	err error
 
 	endpoint string
 	stop     bool
@@ -51,6 +101,15 @@ type RTCRouter struct {
 }
 
 func NewRTCRouter(streamURL string, endpoint string) (router *RTCRouter, err error) {
+	return NewRTCRouterWithConfig(streamURL, endpoint, Config{})
+}
+
+// NewRTCRouterWithConfig creates a router with its own transcoding settings.
+func NewRTCRouterWithConfig(streamURL string, endpoint string, config Config) (router *RTCRouter, err error) {
+
+	if err = config.validate(); err != nil {
+		return
+	}
 
 	var u *url.URL
 	u, err = url.Parse(streamURL)
@@ -71,36 +130,119 @@ func NewRTCRouter(streamURL string, endpoint string) (router *RTCRouter, err err
 		return
 	}
 
-	videoCodec := webrtc.NewRTPH264Codec(H264PayloadTYpe, 90000)
-	audioCodec := webrtc.NewRTPOpusCodec(OpusPayloadType, 48000)
+	// probe the source first, subscribers only get the tracks it has
+	streams, err := conn.Streams()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	videoSource, audioSource, err := sourceCodecs(streams)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var profile profileLevelID
+	var filter *bitstream.Filter
+	if videoSource != nil {
+		if profile, err = spsProfileLevelID(videoSource.SPS()); err != nil {
+			conn.Close()
+			return
+		}
+		filter = videoFilter(videoSource)
+	}
+
+	transform := &trans.Transformer{}
+	if audioSource != nil {
+		if err = setupTransform(transform, audioSource, config); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	// every router has its own ssrcs, transports map them to their tracks
+	videoSSRC := newSSRC()
+	audioSSRC := newSSRC()
+	for audioSSRC == videoSSRC {
+		audioSSRC = newSSRC()
+	}
+	singleNALSSRC := newSSRC()
+	for singleNALSSRC == videoSSRC || singleNALSSRC == audioSSRC {
+		singleNALSSRC = newSSRC()
+	}
+
+	audioVariants := []*audioVariant{}
+	used := []uint32{videoSSRC, audioSSRC, singleNALSSRC}
+	if audioSource != nil {
+		for _, encoding := range []audioEncoding{audioPCMU, audioPCMA} {
+			variant := newG711Variant(encoding, uniqueSSRC(used), audioSource, config)
+			audioVariants = append(audioVariants, variant)
+			used = append(used, variant.ssrc)
+		}
+	}
+
+	var multiopus *webrtc.RTPCodecParameters
+	if multichannel(audioSource, config) {
+		variant, err := newMultiopusVariant(uniqueSSRC(used), audioSource, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		audioVariants = append(audioVariants, variant)
+		multiopus = &variant.codec
+	}
 
 	videoPacketizer := rtp.NewPacketizer(
 		1200,
-		videoCodec.PayloadType,
-		DefaultH264SSRC,
-		videoCodec.Payloader,
+		H264PayloadTYpe,
+		videoSSRC,
+		&codecs.H264Payloader{},
 		rtp.NewRandomSequencer(),
-		videoCodec.ClockRate,
+		90000,
 	)
 
 	audioPacketizer := rtp.NewPacketizer(
 		1200,
-		audioCodec.PayloadType,
-		DefaultOpusSSRC,
-		audioCodec.Payloader,
+		OpusPayloadType,
+		audioSSRC,
+		&codecs.OpusPayloader{},
 		rtp.NewRandomSequencer(),
-		audioCodec.ClockRate,
+		48000,
 	)
 
-	transform := &trans.Transformer{}
+	singleNALPacketizer := rtp.NewPacketizer(
+		1200,
+		H264PayloadTYpe,
+		singleNALSSRC,
+		&singleNALPayloader{streamID: streamID},
+		rtp.NewRandomSequencer(),
+		90000,
+	)
 
 	router = &RTCRouter{}
 	router.streamURL = streamURL
 	router.streamID = streamID
 	router.conn = conn
+	router.streams = streams
+	router.videoCodec = videoSource
+	router.audioCodec = audioSource
+	router.profile = profile
+	router.filter = filter
+	router.opusFmtp = config.Opus.FmtpLine()
+	router.videoSSRC = videoSSRC
+	router.audioSSRC = audioSSRC
 	router.videoPacketizer = videoPacketizer
 	router.audioPacketizer = audioPacketizer
+	router.singleNALSSRC = singleNALSSRC
+	router.singleNALPacketizer = singleNALPacketizer
+	router.audioVariants = audioVariants
+	router.multiopus = multiopus
 	router.outTransports = make(map[string]*RTCTransport, 0)
+	router.audioTransports = make(map[string]*RTCTransport)
+	router.videoTransports = make(map[string]*RTCTransport)
+	router.singleNALTransports = make(map[string]*RTCTransport)
+	router.syncs = make(map[uint32]syncPoint)
 	router.transform = transform
 	router.endpoint = endpoint
 
@@ -109,7 +251,9 @@ func NewRTCRouter(streamURL string, endpoint string) (router *RTCRouter, err err
 	return
 }
 
-func (self *RTCRouter) CreateSubscriber() (*RTCTransport, error) {
+// CreateSubscriber creates a transport for this router, kinds limits the
+// negotiated tracks to audio or video, no kinds means both.
+func (self *RTCRouter) CreateSubscriber(kinds ...webrtc.RTPCodecType) (*RTCTransport, error) {
 
 	id := uuid.NewV4().String()
 	transport, err := NewRTCTransport(id, self.endpoint)
@@ -118,133 +262,657 @@ func (self *RTCRouter) CreateSubscriber() (*RTCTransport, error) {
 		return nil, err
 	}
 
+	if err = self.AddSubscriber(transport, kinds...); err != nil {
+		transport.Stop()
+		return nil, err
+	}
+
+	return transport, nil
+}
+
+// AddSubscriber adds the tracks of this router to an existing transport, so
+// one PeerConnection can carry several streams. A negotiated transport asks
+// for renegotiation, see RTCTransport.OnNegotiationNeeded.
+func (self *RTCRouter) AddSubscriber(transport *RTCTransport, kinds ...webrtc.RTPCodecType) error {
+
+	self.RLock()
+	err := self.stoppedErr()
+	self.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	audio, video, err := subscriberKinds(kinds)
+	if err != nil {
+		return err
+	}
+
+	// kinds the source lacks are left out of the negotiation
+	audio = audio && self.audioCodec != nil
+	video = video && self.videoCodec != nil
+	if !audio && !video {
+		return fmt.Errorf("stream %s has none of the requested tracks", self.streamID)
+	}
+
+	if err = transport.addStream(self, audio, video); err != nil {
+		return err
+	}
+
+	// the router may have stopped meanwhile
 	self.Lock()
-	self.outTransports[id] = transport
+	err = self.addTransport(transport, audio, video)
 	self.Unlock()
+	if err != nil {
+		transport.removeStream(self)
+		return err
+	}
 
-	return transport, nil
+	return nil
 }
 
+// StopSubscriber removes the tracks of this router from the transport, the
+// transport itself keeps running.
 func (self *RTCRouter) StopSubscriber(transport *RTCTransport) {
 
 	self.Lock()
-	delete(self.outTransports, transport.ID())
+	self.removeTransport(transport)
 	self.Unlock()
+
+	transport.removeStream(self)
 }
 
-func (self *RTCRouter) readPacket() {
+// SwitchSubscriber moves the transport's stream of this router to another
+// router without renegotiation. The tracks keep their ssrcs, video is held
+// until the next live keyframe of the new router since the frames before it
+// reference pictures the subscriber never got. An rtmp source can not be
+// asked for a keyframe, so the picture freezes for up to a gop.
+func (self *RTCRouter) SwitchSubscriber(transport *RTCTransport, to *RTCRouter) error {
 
-	var err error
-	self.streams, err = self.conn.Streams()
+	to.RLock()
+	err := to.stoppedErr()
+	to.RUnlock()
 	if err != nil {
-		fmt.Println(err)
+		return err
+	}
+
+	if err := transport.switchStream(self, to); err != nil {
+		return err
+	}
+
+	self.Lock()
+	self.removeTransport(transport)
+	self.Unlock()
+
+	audio, video := transport.streamKinds(to)
+
+	to.Lock()
+	err = to.addTransport(transport, audio, video)
+	to.Unlock()
+
+	if err != nil {
+		// the new router stopped meanwhile, the stream goes back
+		self.switchBack(transport, to, audio, video)
+		return err
+	}
+
+	return nil
+}
+
+// switchBack returns a stream that could not switch to a stopped router, it
+// is removed when this router stopped as well.
+func (self *RTCRouter) switchBack(transport *RTCTransport, from *RTCRouter, audio bool, video bool) {
+
+	if transport.switchStream(from, self) != nil {
+		transport.removeStream(from)
 		return
 	}
 
-	defer self.conn.Close()
+	self.Lock()
+	err := self.addTransport(transport, audio, video)
+	self.Unlock()
+	if err != nil {
+		transport.removeStream(self)
+	}
+}
+
+// SetKeyFrameOnly makes the router forward only keyframes with their SPS/PPS
+// to the subscriber, for monitoring walls that show many streams at a low
+// frame rate. Audio is dropped unless audio is set. It can be switched at any
+// time, full frame rate resumes with the next keyframe.
+func (self *RTCRouter) SetKeyFrameOnly(transport *RTCTransport, keyFrameOnly bool, audio bool) error {
+	return transport.setKeyFrameOnly(self, keyFrameOnly, audio)
+}
+
+// SetBFramePolicy sets what happens when the source turns out to have
+// B-frames, see BFramePolicy.
+func (self *RTCRouter) SetBFramePolicy(policy BFramePolicy) {
+
+	self.Lock()
+	self.bframePolicy = policy
+	self.Unlock()
+}
+
+// Err tells why the router stopped on its own, nil while it runs or when it
+// was stopped with Stop.
+func (self *RTCRouter) Err() error {
+
+	self.RLock()
+	defer self.RUnlock()
+	return self.err
+}
+
+// Kinds reports the tracks of the source, subscribers are negotiated with
+// those only.
+func (self *RTCRouter) Kinds() []webrtc.RTPCodecType {
+	return sourceKinds(self.videoCodec, self.audioCodec)
+}
+
+// Loudness reports the loudness of the source audio, measured by the stereo
+// opus transcoding while it has subscribers. It is false without a source
+// audio or a Config.Loudness processing.
+func (self *RTCRouter) Loudness() (trans.Loudness, bool) {
+	return self.transform.Loudness()
+}
+
+func (self *RTCRouter) SubscriberCount() int {
+
+	self.RLock()
+	defer self.RUnlock()
+	return len(self.outTransports)
+}
+
+// stoppedErr tells why the router does not take subscribers, nil while it
+// runs. The caller holds the lock.
+func (self *RTCRouter) stoppedErr() error {
+
+	if !self.stop {
+		return nil
+	}
+	if self.err != nil {
+		return self.err
+	}
+	return fmt.Errorf("router %s is stopped", self.streamID)
+}
+
+func (self *RTCRouter) isStopped() bool {
+
+	self.RLock()
+	defer self.RUnlock()
+	return self.stop
+}
+
+// addTransport registers the transport for the kinds it subscribes, a stopped
+// router has no subscriber sets left. The caller holds the lock.
+func (self *RTCRouter) addTransport(transport *RTCTransport, audio bool, video bool) error {
+
+	if err := self.stoppedErr(); err != nil {
+		return err
+	}
+
+	self.outTransports[transport.ID()] = transport
+	if audio {
+		self.audioTransportsOf(transport.audioEncodingOf(self))[transport.ID()] = transport
+	}
+	if video && transport.isSingleNAL() {
+		self.singleNALTransports[transport.ID()] = transport
+	} else if video {
+		self.videoTransports[transport.ID()] = transport
+	}
+	return nil
+}
+
+func (self *RTCRouter) removeTransport(transport *RTCTransport) {
+
+	delete(self.outTransports, transport.ID())
+	delete(self.audioTransports, transport.ID())
+	delete(self.videoTransports, transport.ID())
+	delete(self.singleNALTransports, transport.ID())
+	for _, variant := range self.audioVariants {
+		delete(variant.transports, transport.ID())
+	}
+}
+
+// setSingleNAL moves a video subscriber to the packetization variant it
+// negotiated.
+func (self *RTCRouter) setSingleNAL(transport *RTCTransport, singleNAL bool) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	id := transport.ID()
+	_, fuA := self.videoTransports[id]
+	_, single := self.singleNALTransports[id]
+	if !fuA && !single {
+		return
+	}
+
+	delete(self.videoTransports, id)
+	delete(self.singleNALTransports, id)
+	if singleNAL {
+		self.singleNALTransports[id] = transport
+	} else {
+		self.videoTransports[id] = transport
+	}
+}
+
+// setAudioEncoding moves an audio subscriber to the variant of the audio
+// codec it negotiated.
+func (self *RTCRouter) setAudioEncoding(transport *RTCTransport, encoding audioEncoding) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	id := transport.ID()
+	subscribed := false
+	for _, transports := range self.allAudioTransports() {
+		if _, ok := transports[id]; ok {
+			subscribed = true
+			delete(transports, id)
+		}
+	}
+	if subscribed {
+		self.audioTransportsOf(encoding)[id] = transport
+	}
+}
+
+// audioTransportsOf returns the subscribers of the audio encoding, the caller
+// holds the lock. An encoding without a variant falls back to stereo opus.
+func (self *RTCRouter) audioTransportsOf(encoding audioEncoding) map[string]*RTCTransport {
+
+	for _, variant := range self.audioVariants {
+		if variant.encoding == encoding {
+			return variant.transports
+		}
+	}
+	return self.audioTransports
+}
 
-	for _, stream := range self.streams {
-		if stream.Type() == av.H264 {
-			self.videoCodec = stream.(h264.CodecData)
+func (self *RTCRouter) allAudioTransports() []map[string]*RTCTransport {
+
+	all := []map[string]*RTCTransport{self.audioTransports}
+	for _, variant := range self.audioVariants {
+		all = append(all, variant.transports)
+	}
+	return all
+}
+
+// hasAudioVariant tells if the router produces the encoding, stereo opus
+// always exists.
+func (self *RTCRouter) hasAudioVariant(encoding audioEncoding) bool {
+
+	if encoding == audioOpus {
+		return true
+	}
+	for _, variant := range self.audioVariants {
+		if variant.encoding == encoding {
+			return true
 		}
-		if stream.Type() == av.AAC {
-			self.audioCodec = stream.(aac.CodecData)
-			self.transform.SetInSampleRate(self.audioCodec.SampleRate())
-			self.transform.SetInChannelLayout(self.audioCodec.ChannelLayout())
-			self.transform.SetInSampleFormat(self.audioCodec.SampleFormat())
-			self.transform.SetOutChannelLayout(av.CH_STEREO)
-			self.transform.SetOutSampleRate(48000)
-			self.transform.SetOutSampleFormat(av.S16)
-			self.transform.Setup()
+	}
+	return false
+}
+
+func (self *RTCRouter) wantsAudio() bool {
+
+	self.RLock()
+	defer self.RUnlock()
+	return len(self.audioTransports) > 0
+}
+
+func (self *RTCRouter) wantsSingleNAL() bool {
+
+	self.RLock()
+	defer self.RUnlock()
+	return len(self.singleNALTransports) > 0
+}
+
+func (self *RTCRouter) wantsVariant(variant *audioVariant) bool {
+
+	self.RLock()
+	defer self.RUnlock()
+	return len(variant.transports) > 0
+}
+
+// ssrcs lists the ssrcs of the router packets of kind, video has one per
+// packetization variant and audio one per codec.
+func (self *RTCRouter) ssrcs(kind webrtc.RTPCodecType) []uint32 {
+
+	if kind == webrtc.RTPCodecTypeVideo {
+		return []uint32{self.videoSSRC, self.singleNALSSRC}
+	}
+	ssrcs := []uint32{self.audioSSRC}
+	for _, variant := range self.audioVariants {
+		ssrcs = append(ssrcs, variant.ssrc)
+	}
+	return ssrcs
+}
+
+func subscriberKinds(kinds []webrtc.RTPCodecType) (audio bool, video bool, err error) {
+
+	if len(kinds) == 0 {
+		return true, true, nil
+	}
+
+	for _, kind := range kinds {
+		switch kind {
+		case webrtc.RTPCodecTypeAudio:
+			audio = true
+		case webrtc.RTPCodecTypeVideo:
+			video = true
+		default:
+			return false, false, fmt.Errorf("unknown media kind %v", kind)
 		}
 	}
+	return audio, video, nil
+}
+
+func (self *RTCRouter) readPacket() {
+
+	defer self.conn.Close()
+	defer self.closeVariants()
 
 	for {
 		packet, err := self.conn.ReadPacket()
 		if err != nil {
-			fmt.Println("read packet error", err)
+			log.Debug().Msgf("router %s read packet error %v", self.streamID, err)
 			break
 		}
 
-		if self.stop {
+		if self.isStopped() {
 			break
 		}
 
-		fmt.Println("router ", packet.Time)
-
 		stream := self.streams[packet.Idx]
 
+		if self.epoch.IsZero() {
+			self.epoch = time.Now().Add(-packet.Time)
+		}
+
 		if stream.Type().IsVideo() {
-			var samples uint32
-			if self.lastVideoTime == 0 {
-				samples = 0
-			} else {
-				samples = uint32(uint64(packet.Time-self.lastVideoTime) * 90000 / 1000000000)
-			}
 
-			var b bytes.Buffer
-			if packet.IsKeyFrame {
-				b.Write(NALUHeader)
-				b.Write(self.videoCodec.SPS())
-				b.Write(NALUHeader)
-				b.Write(self.videoCodec.PPS())
+			nalus, err := self.filter.Filter(packet.Data, packet.IsKeyFrame)
+			if err != nil {
+				log.Debug().Msgf("router %s drops video packet at %v: %v", self.streamID, packet.Time, err)
+				continue
+			}
+			if len(nalus) == 0 {
+				continue
 			}
 
-			if packet.Data[0] == 0x00 && packet.Data[1] == 0x00 && packet.Data[2] == 0x00 && packet.Data[3] == 0x01 {
-				b.Write(packet.Data)
-			} else {
-				nalus, _ := h264.SplitNALUs(packet.Data)
-				for _, nalu := range nalus {
-					b.Write(naluHeader)
-					b.Write(nalu)
+			if !self.bframes && hasBFrame(nalus) {
+				if err := self.detectedBFrames(); err != nil {
+					log.Debug().Msgf("router %s stops: %v", self.streamID, err)
+					self.fail(err)
+					return
 				}
 			}
 
-			packets := self.videoPacketizer.Packetize(b.Bytes(), samples)
-			self.writePackets(packets)
+			au := bitstream.JoinAnnexB(nalus)
+
+			// rtp carries the presentation time, frames stay in decode order
+			pts := packet.Time + packet.CompositionTime
+
+			packets := self.videoPacketizer.Packetize(au, 0)
+			self.retimeVideo(packets, pts)
+			self.setSyncPoint(packets, pts)
+			self.writePackets(webrtc.RTPCodecTypeVideo, packets)
+
+			if self.wantsSingleNAL() {
+				packets = self.singleNALPacketizer.Packetize(au, 0)
+				self.retimeVideo(packets, pts)
+				self.setSyncPoint(packets, pts)
+				self.writeSingleNALPackets(packets)
+			}
 			self.lastVideoTime = packet.Time
 
-		} else if stream.Type() == av.AAC {
+		} else if stream.Type().IsAudio() {
+
+			for _, variant := range self.audioVariants {
+				if self.wantsVariant(variant) {
+					self.writeVariant(variant, packet)
+				} else {
+					// the last subscriber left
+					variant.close()
+				}
+			}
+
+			// nobody listens, save the transcoding
+			if !self.wantsAudio() {
+				continue
+			}
 
 			pkts, err := self.transform.Do(packet)
 			if err != nil {
-				fmt.Println("transform error", err)
+				log.Debug().Msgf("router %s transform error %v", self.streamID, err)
 				continue
 			}
 
 			for _, pkt := range pkts {
-				packets := self.audioPacketizer.Packetize(pkt.Data, 960)
-				self.writePackets(packets)
+				packets := self.audioPacketizer.Packetize(pkt.Data, opusSamples(pkt.Data))
+				self.retimeAudio(packets, pkt)
+				self.setSyncPoint(packets, pkt.Time)
+				self.writePackets(webrtc.RTPCodecTypeAudio, packets)
 				self.lastAudioTime = pkt.Time
 			}
 		}
 	}
 }
 
-func (self *RTCRouter) writePackets(pkts []*rtp.Packet) {
+// retimeAudio sets the rtp timestamp of the opus packets from the packet
+// time. A gap is kept as it is and marked like the start of a talkspurt, a
+// step back continues after the last packet, both are reported.
+func (self *RTCRouter) retimeAudio(packets []*rtp.Packet, pkt av.Packet) {
+
+	if len(packets) == 0 {
+		return
+	}
+
+	discontinuity := false
+	if !self.audioStarted {
+		self.audioBase = packets[0].Timestamp - audioRTPTime(pkt.Time)
+		self.audioStarted = true
+	} else if pkt.Time > self.audioNext+self.audioDuration {
+		log.Debug().Msgf("router %s audio gap of %v at %v", self.streamID, pkt.Time-self.audioNext, pkt.Time)
+		discontinuity = true
+	} else if pkt.Time < self.audioNext-self.audioDuration {
+		log.Debug().Msgf("router %s audio time steps back %v at %v", self.streamID, self.audioNext-pkt.Time, pkt.Time)
+		self.audioBase = self.audioBase + audioRTPTime(self.audioNext) - audioRTPTime(pkt.Time)
+		discontinuity = true
+	}
+
+	self.audioDuration = opusDuration(pkt.Data)
+	self.audioNext = pkt.Time + self.audioDuration
+
+	for _, packet := range packets {
+		packet.Timestamp = self.audioBase + audioRTPTime(pkt.Time)
+		packet.Marker = discontinuity
+	}
+}
+
+// retimeVideo stamps the packets of an access unit with its presentation
+// time. Both packetization variants share videoBase.
+func (self *RTCRouter) retimeVideo(packets []*rtp.Packet, pts time.Duration) {
+
+	if len(packets) == 0 {
+		return
+	}
+
+	if !self.videoStarted {
+		self.videoBase = packets[0].Timestamp - videoRTPTime(pts)
+		self.videoStarted = true
+	}
+
+	for _, packet := range packets {
+		packet.Timestamp = self.videoBase + videoRTPTime(pts)
+	}
+}
+
+// detectedBFrames applies the b-frame policy to the first B slice, an error
+// means the router has to stop.
+func (self *RTCRouter) detectedBFrames() error {
+
+	self.Lock()
+	self.bframes = true
+	policy := self.bframePolicy
+	self.Unlock()
+
+	switch policy {
+	case BFrameReject:
+		return fmt.Errorf("stream %s has b-frames, the router rejects them", self.streamID)
+	case BFrameWarn:
+		log.Debug().Msgf("router %s has b-frames, browsers may play them with judder", self.streamID)
+	}
+	return nil
+}
+
+// fail stops the router and keeps err for Err and new subscribers.
+func (self *RTCRouter) fail(err error) {
+
+	self.Lock()
+	self.err = err
+	self.Unlock()
+
+	self.Stop()
+}
+
+func videoRTPTime(t time.Duration) uint32 {
+	return uint32(int64(t) * 90000 / int64(time.Second))
+}
+
+func audioRTPTime(t time.Duration) uint32 {
+	return uint32(int64(t) * 48000 / int64(time.Second))
+}
+
+// setSyncPoint records the rtp timestamp of packets for their rtmp time.
+func (self *RTCRouter) setSyncPoint(packets []*rtp.Packet, mediaTime time.Duration) {
+
+	if len(packets) == 0 {
+		return
+	}
+
+	self.Lock()
+	self.syncs[packets[0].SSRC] = syncPoint{rtpTime: packets[0].Timestamp, wall: self.epoch.Add(mediaTime)}
+	self.Unlock()
+}
+
+func (self *RTCRouter) syncPoint(ssrc uint32) (syncPoint, bool) {
+
 	self.RLock()
 	defer self.RUnlock()
+	sync, ok := self.syncs[ssrc]
+	return sync, ok
+}
+
+func (self *RTCRouter) writePackets(kind webrtc.RTPCodecType, pkts []*rtp.Packet) {
+	self.RLock()
+	defer self.RUnlock()
+
+	transports := self.audioTransports
+	if kind == webrtc.RTPCodecTypeVideo {
+		transports = self.videoTransports
+	}
 
 	for _, pkt := range pkts {
-		for _, transport := range self.outTransports {
+		for _, transport := range transports {
 			transport.WriteRTP(pkt)
 		}
 	}
 }
 
-func (self *RTCRouter) Stop() (err error) {
+// closeVariants stops the transcoding of every audio variant, the read loop
+// calls it when it ends.
+func (self *RTCRouter) closeVariants() {
 
-	if self.stop {
+	for _, variant := range self.audioVariants {
+		variant.close()
+	}
+}
+
+// writeVariant transcodes the source packet for the subscribers of the
+// variant.
+func (self *RTCRouter) writeVariant(variant *audioVariant, packet av.Packet) {
+
+	failed := variant.err != nil
+	packets, times, err := variant.packets(packet)
+	if err != nil {
+		// a failed setup is not tried again, it is told once
+		if !failed {
+			log.Debug().Msgf("router %s %s transcoding error %v", self.streamID, variant.encoding, err)
+		}
 		return
 	}
-	self.stop = true
+
+	for i, pkts := range packets {
+		self.setSyncPoint(pkts, times[i])
+
+		self.RLock()
+		for _, pkt := range pkts {
+			for _, transport := range variant.transports {
+				transport.WriteRTP(pkt)
+			}
+		}
+		self.RUnlock()
+	}
+}
+
+func (self *RTCRouter) writeSingleNALPackets(pkts []*rtp.Packet) {
+	self.RLock()
+	defer self.RUnlock()
+
+	for _, pkt := range pkts {
+		for _, transport := range self.singleNALTransports {
+			transport.WriteRTP(pkt)
+		}
+	}
+}
+
+func (self *RTCRouter) Stop() (err error) {
 
 	self.Lock()
 	defer self.Unlock()
 
+	if self.stop {
+		return
+	}
+	self.stop = true
+
+	// transports carrying other streams keep running
 	for _, transport := range self.outTransports {
-		transport.Stop()
+		if transport.removeStream(self) == 0 {
+			transport.Stop()
+		}
 	}
 	self.outTransports = nil
+	self.audioTransports = nil
+	self.videoTransports = nil
+	self.singleNALTransports = nil
+	for _, variant := range self.audioVariants {
+		variant.transports = nil
+	}
 	return
 }
+
+// uniqueSSRC returns a new ssrc not in used.
+func uniqueSSRC(used []uint32) uint32 {
+
+	for {
+		ssrc := newSSRC()
+		unique := true
+		for _, u := range used {
+			unique = unique && u != ssrc
+		}
+		if unique {
+			return ssrc
+		}
+	}
+}
+
+func newSSRC() uint32 {
+
+	b := make([]byte, 4)
+	rand.Read(b)
+	ssrc := binary.BigEndian.Uint32(b)
+	if ssrc == 0 {
+		ssrc = 1
+	}
+	return ssrc
+}
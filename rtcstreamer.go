@@ -1,10 +1,508 @@
 package rtcrtmp
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	rtputil "github.com/notedit/rtc-rtmp/rtp"
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/h264"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
 
+const (
+	rtcVideoIdx = 0
+	rtcAudioIdx = 1
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+)
+
+// PacketWriter receives the stream of a RTCStreamer,
+// both *rtmp.Conn and *pubsub.Queue can be used.
+type PacketWriter interface {
+	WriteHeader(streams []av.CodecData) error
+	WritePacket(pkt av.Packet) error
+	WriteTrailer() error
+	Close() error
+}
+
+// trackClock maps rtp timestamps of one track to stream time. The first
+// packet is placed at its arrival time, so audio and video share a timeline.
+type trackClock struct {
+	inited    bool
+	timestamp uint32
+	offset    time.Duration
+}
+
+func (self *trackClock) time(start time.Time, timestamp uint32, clockrate uint32) time.Duration {
+	if !self.inited {
+		self.inited = true
+		self.timestamp = timestamp
+		self.offset = time.Since(start)
+	}
+	return self.offset + time.Duration(timestamp-self.timestamp)*time.Second/time.Duration(clockrate)
+}
+
+// RTCStreamer receives H264 and Opus from a WebRTC publisher and writes H264
+// and AAC to a PacketWriter, it is the reverse of RtmpStreamer.
 type RTCStreamer struct {
+	id       string
+	endpoint string
+	pc       *webrtc.PeerConnection
+
+	writer     PacketWriter
+	videoCodec h264.CodecData
+	// the transform encoder format is fixed, so is its codec data
+	audioCodec av.AudioCodecData
+	videoReady bool
+	header     bool
+	keyframe   bool
+	sps        []byte
+	pps        []byte
+
+	transform *trans.Transformer
+
+	depacketizer *rtputil.H264Depacketizer
+	nalus        [][]byte
+	frameTime    uint32
+
+	start      time.Time
+	videoClock trackClock
+	audioClock trackClock
+
+	localsdp  string
+	remotesdp string
+	closed    bool
+	onClose   func()
+	sync.Mutex
+}
+
+func NewRTCStreamer(id string, endpoint string, writer PacketWriter) (*RTCStreamer, error) {
+
+	transform := &trans.Transformer{}
+	transform.SetInCodec("libopus")
+	transform.SetOutCodec("aac")
+	transform.SetInSampleRate(48000)
+	transform.SetInChannelLayout(av.CH_STEREO)
+	transform.SetInSampleFormat(av.S16)
+	transform.SetOutSampleRate(48000)
+	transform.SetOutChannelLayout(av.CH_STEREO)
+	transform.SetOutSampleFormat(av.FLTP)
+	transform.SetOutBitrate(128000)
+	if err := transform.Setup(); err != nil {
+		return nil, err
+	}
+	audioCodec, err := transform.CodecData()
+	if err != nil {
+		transform.Close()
+		return nil, err
+	}
+
+	streamer := &RTCStreamer{}
+	streamer.id = id
+	streamer.endpoint = endpoint
+	streamer.writer = writer
+	streamer.transform = transform
+	streamer.audioCodec = audioCodec
+	streamer.depacketizer = rtputil.NewH264Depacketizer()
+	streamer.start = time.Now()
+
+	return streamer, nil
+}
+
+func (self *RTCStreamer) ID() string {
+	return self.id
+}
+
+// newPeerConnection builds a receive only PeerConnection that uses the
+// payload types of the offer for H264 and Opus.
+func (self *RTCStreamer) newPeerConnection(offer string) (*webrtc.PeerConnection, error) {
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return nil, err
+	}
+
+	h264Type, ok := payloadTypeFromSDP(&desc, "H264", "packetization-mode=1")
+	if !ok {
+		return nil, fmt.Errorf("offer does not have h264 with packetization-mode=1")
+	}
+	opusType, ok := payloadTypeFromSDP(&desc, "opus", "")
+	if !ok {
+		return nil, fmt.Errorf("offer does not have opus")
+	}
+	// the offered h264 fmtp keeps formats of other profiles out of the answer
+	h264Codec, err := desc.GetCodecForPayloadType(h264Type)
+	if err != nil {
+		return nil, err
+	}
+
+	rtcpfb := []webrtc.RTCPFeedback{
+		webrtc.RTCPFeedback{
+			Type: webrtc.TypeRTCPFBNACK,
+		},
+		webrtc.RTCPFeedback{
+			Type:      webrtc.TypeRTCPFBNACK,
+			Parameter: "pli",
+		},
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetICETimeouts(5*time.Second, 10*time.Second, 2*time.Second)
+	s.SetLite(true)
+	if self.endpoint != "" {
+		s.SetNAT1To1IPs([]string{self.endpoint}, webrtc.ICECandidateTypeHost)
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err = m.RegisterCodec(newOpusCodec(opusType, ""), webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	if err = m.RegisterCodec(newH264Codec(h264Type, h264Codec.Fmtp, rtcpfb), webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m))
+
+	config := webrtc.Configuration{
+		ICEServers:   []webrtc.ICEServer{},
+		BundlePolicy: webrtc.BundlePolicyMaxBundle,
+		SDPSemantics: webrtc.SDPSemanticsUnifiedPlan,
+	}
+
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return nil, err
+	}
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return nil, err
+	}
+
+	pc.OnTrack(self.onTrack)
+	pc.OnConnectionStateChange(self.onConnectionState)
+
+	return pc, nil
+}
+
+func (self *RTCStreamer) GetLocalSDP(sdpType webrtc.SDPType) (string, error) {
+
+	if self.pc == nil {
+		return "", fmt.Errorf("peerconnection does not init yet")
+	}
+
+	if sdpType != webrtc.SDPTypeAnswer {
+		return "", fmt.Errorf("streamer can only answer")
+	}
+
+	if self.localsdp == "" {
+		sdp, err := self.pc.CreateAnswer(nil)
+		if err != nil {
+			return "", err
+		}
+		// whip has no trickle from the server, the answer carries the candidates
+		gathered := webrtc.GatheringCompletePromise(self.pc)
+		if err = self.pc.SetLocalDescription(sdp); err != nil {
+			return "", err
+		}
+		<-gathered
+		self.localsdp = self.pc.LocalDescription().SDP
+	}
+
+	return self.localsdp, nil
+}
+
+// SetRemoteSDP takes the publisher offer. The PeerConnection is created here
+// since its codecs follow the offer, an offer with new ice credentials
+// restarts ice on it.
+func (self *RTCStreamer) SetRemoteSDP(sdpStr string, sdpType webrtc.SDPType) error {
+
+	if sdpType != webrtc.SDPTypeOffer {
+		return fmt.Errorf("streamer can only answer")
+	}
+
+	if self.pc == nil {
+		pc, err := self.newPeerConnection(sdpStr)
+		if err != nil {
+			return err
+		}
+		self.pc = pc
+	}
+	self.localsdp = ""
+
+	self.remotesdp = sdpStr
+	sdp := webrtc.SessionDescription{SDP: sdpStr, Type: sdpType}
+	return self.pc.SetRemoteDescription(sdp)
+}
+
+func (self *RTCStreamer) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+
+	if self.pc == nil {
+		return fmt.Errorf("peerconnection does not init yet")
+	}
+
+	return self.pc.AddICECandidate(candidate)
+}
+
+// ApplySDPFrag handles a trickle ice PATCH body, see applySDPFrag.
+func (self *RTCStreamer) ApplySDPFrag(frag *SDPFrag) (*SDPFrag, error) {
+	return applySDPFrag(self, self.remotesdp, frag)
+}
+
+func (self *RTCStreamer) onConnectionState(state webrtc.PeerConnectionState) {
 
+	log.Debug().Msgf("streamer %s %s", self.id, state)
+
+	if state == webrtc.PeerConnectionStateFailed {
+		self.Close()
+	}
+}
+
+func (self *RTCStreamer) onTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		go self.requestKeyFrame(uint32(track.SSRC()))
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			self.handleVideo(packet)
+		} else {
+			self.handleAudio(packet)
+		}
+	}
+}
+
+// requestKeyFrame sends PLI until the first key frame is written.
+func (self *RTCStreamer) requestKeyFrame(ssrc uint32) {
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		self.Lock()
+		done := self.keyframe || self.closed
+		pc := self.pc
+		self.Unlock()
+
+		if done {
+			return
+		}
+		pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+	}
+}
+
+func (self *RTCStreamer) handleVideo(packet *rtp.Packet) {
+
+	if len(packet.Payload) < 2 {
+		return
+	}
+
+	if len(self.nalus) > 0 && packet.Timestamp != self.frameTime {
+		self.writeVideoFrame()
+	}
+	self.frameTime = packet.Timestamp
+
+	nalus, ok := self.depacketizer.Depacket(packet.Payload)
+	if ok {
+		self.nalus = append(self.nalus, nalus...)
+	}
+
+	if packet.Marker {
+		self.writeVideoFrame()
+	}
+}
+
+// writeVideoFrame turns the nalus of one access unit into an AVCC packet.
+// SPS and PPS go into the codec data instead of the packet.
+func (self *RTCStreamer) writeVideoFrame() {
+
+	var b bytes.Buffer
+	var keyframe bool
+	var length [4]byte
+
+	for _, nalu := range self.nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			self.sps = nalu
+			continue
+		case naluTypePPS:
+			self.pps = nalu
+			continue
+		case naluTypeAUD:
+			continue
+		case naluTypeIDR:
+			keyframe = true
+		}
+		binary.BigEndian.PutUint32(length[:], uint32(len(nalu)))
+		b.Write(length[:])
+		b.Write(nalu)
+	}
+	self.nalus = nil
+
+	if !self.videoReady && self.sps != nil && self.pps != nil {
+		codec, err := h264.NewCodecDataFromSPSAndPPS(self.sps, self.pps)
+		if err != nil {
+			log.Debug().Msgf("streamer %s parse sps error %v", self.id, err)
+			return
+		}
+		self.videoCodec = codec
+		self.videoReady = true
+		self.writeHeader()
+	}
+
+	if b.Len() == 0 {
+		return
+	}
+
+	self.Lock()
+	if keyframe {
+		self.keyframe = true
+	}
+	ready := self.keyframe
+	self.Unlock()
+
+	if !ready {
+		return
+	}
+
+	self.writePacket(av.Packet{
+		Idx:        rtcVideoIdx,
+		IsKeyFrame: keyframe,
+		Time:       self.videoClock.time(self.start, self.frameTime, 90000),
+		Data:       b.Bytes(),
+	})
 }
 
+func (self *RTCStreamer) handleAudio(packet *rtp.Packet) {
 
+	if len(packet.Payload) == 0 {
+		return
+	}
 
+	pkt := av.Packet{
+		Idx:  rtcAudioIdx,
+		Time: self.audioClock.time(self.start, packet.Timestamp, 48000),
+		Data: packet.Payload,
+	}
+
+	pkts, err := self.transform.Do(pkt)
+	if err != nil {
+		log.Error().Msgf("streamer %s transform error %v", self.id, err)
+		return
+	}
+
+	for _, pkt := range pkts {
+		self.writePacket(pkt)
+	}
+}
+
+func (self *RTCStreamer) writeHeader() {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.closed {
+		return
+	}
+
+	streams := []av.CodecData{self.videoCodec, self.audioCodec}
+	if err := self.writer.WriteHeader(streams); err != nil {
+		log.Debug().Msgf("streamer %s write header error %v", self.id, err)
+		return
+	}
+	self.header = true
+}
+
+func (self *RTCStreamer) writePacket(pkt av.Packet) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.closed || !self.header || !self.keyframe {
+		return
+	}
+
+	if err := self.writer.WritePacket(pkt); err != nil {
+		log.Debug().Msgf("streamer %s write packet error %v", self.id, err)
+	}
+}
+
+// OnClose sets the handler called once the streamer is closed, by Close or
+// by a failed connection.
+func (self *RTCStreamer) OnClose(f func()) {
+	self.Lock()
+	self.onClose = f
+	self.Unlock()
+}
+
+func (self *RTCStreamer) Close() {
+
+	self.Lock()
+
+	if self.closed {
+		self.Unlock()
+		return
+	}
+	self.closed = true
+
+	if self.pc != nil {
+		self.pc.Close()
+	}
+	if self.header {
+		self.writer.WriteTrailer()
+	}
+	self.writer.Close()
+	self.transform.Close()
+
+	f := self.onClose
+	self.Unlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+// payloadTypeFromSDP finds the first payload type of the codec whose fmtp
+// contains the given parameter.
+func payloadTypeFromSDP(desc *sdp.SessionDescription, name string, fmtp string) (uint8, bool) {
+
+	for _, media := range desc.MediaDescriptions {
+		for _, format := range media.MediaName.Formats {
+			var payloadType uint8
+			if _, err := fmt.Sscanf(format, "%d", &payloadType); err != nil {
+				continue
+			}
+			codec, err := desc.GetCodecForPayloadType(payloadType)
+			if err != nil || !strings.EqualFold(codec.Name, name) {
+				continue
+			}
+			if fmtp == "" || strings.Contains(codec.Fmtp, fmtp) {
+				return payloadType, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -1,33 +1,36 @@
 package rtcrtmp
 
 import (
-	"bytes"
 	"fmt"
 	"time"
 
+	"github.com/notedit/rtc-rtmp/bitstream"
 	"github.com/notedit/rtc-rtmp/trans"
 	"github.com/notedit/rtmp-lib"
-	"github.com/notedit/rtmp-lib/aac"
 	"github.com/notedit/rtmp-lib/av"
 	"github.com/notedit/rtmp-lib/h264"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/rs/zerolog/log"
 	uuid "github.com/satori/go.uuid"
 )
 
-var naluHeader = []byte{0, 0, 0, 1}
 
 
 type RtmpStreamer struct {
 	streams    []av.CodecData
-	videoCodec h264.CodecData
-	audioCodec aac.CodecData
+	// nil when the source has no such stream
+	videoCodec *h264.CodecData
+	audioCodec av.AudioCodecData
+	profile    *profileLevelID
+	filter     *bitstream.Filter
 	adtsheader []byte
 	spspps     bool
 
 	transform *trans.Transformer
 
-	audioTrack *webrtc.Track
-	videoTrack *webrtc.Track
+	audioTrack *webrtc.TrackLocalStaticSample
+	videoTrack *webrtc.TrackLocalStaticSample
 
 	localSDP  string
 	remoteSDP string
@@ -42,50 +45,126 @@ type RtmpStreamer struct {
 }
 
 func NewRtmpStreamer(streamURL string) (*RtmpStreamer, error) {
+	return NewRtmpStreamerWithConfig(streamURL, Config{})
+}
 
-	config := webrtc.Configuration{
-		ICEServers:   []webrtc.ICEServer{},
-		BundlePolicy: webrtc.BundlePolicyMaxBundle,
-		SDPSemantics: webrtc.SDPSemanticsUnifiedPlan,
-	}
+// NewRtmpStreamerWithConfig creates a streamer with its own transcoding
+// settings.
+func NewRtmpStreamerWithConfig(streamURL string, config Config) (*RtmpStreamer, error) {
 
-	s := webrtc.SettingEngine{}
-	s.SetConnectionTimeout(10*time.Second, 2*time.Second)
-	m := webrtc.MediaEngine{}
-	m.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000))
-	m.RegisterCodec(webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, 90000))
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m))
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 
-	peerConnection, err := api.NewPeerConnection(config)
+	// probe the source first, the offer only has the tracks it has
+	conn, err := rtmp.Dial(streamURL)
 	if err != nil {
 		return nil, err
 	}
 
-	streamID := uuid.NewV4().String()
-	audioTrack, err := peerConnection.NewTrack(webrtc.DefaultPayloadTypeOpus, 333, uuid.NewV4().String(), streamID)
-
+	streams, err := conn.Streams()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	videoTrack, err := peerConnection.NewTrack(webrtc.DefaultPayloadTypeH264, 666, uuid.NewV4().String(), streamID)
-
+	videoCodec, audioCodec, err := sourceCodecs(streams)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	peerConnection.AddTransceiverFromTrack(audioTrack, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
-	peerConnection.AddTransceiverFromTrack(videoTrack, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	var profile *profileLevelID
+	if videoCodec != nil {
+		id, err := spsProfileLevelID(videoCodec.SPS())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		profile = &id
+	}
+
+	var filter *bitstream.Filter
+	if videoCodec != nil {
+		filter = videoFilter(videoCodec)
+	}
 
 	transform := &trans.Transformer{}
+	if audioCodec != nil {
+		if err = setupTransform(transform, audioCodec, config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	pcConfig := webrtc.Configuration{
+		ICEServers:   []webrtc.ICEServer{},
+		BundlePolicy: webrtc.BundlePolicyMaxBundle,
+		SDPSemantics: webrtc.SDPSemanticsUnifiedPlan,
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetICETimeouts(5*time.Second, 10*time.Second, 2*time.Second)
+	m := &webrtc.MediaEngine{}
+	opusCodec := newOpusCodec(OpusPayloadType, config.Opus.FmtpLine())
+	h264Fmtp := h264FmtpLine(defaultProfileLevelID, "1")
+	if profile != nil {
+		h264Fmtp = h264FmtpLine(*profile, "1")
+	}
+	h264Codec := newH264Codec(H264PayloadTYpe, h264Fmtp, nil)
+	err = m.RegisterCodec(opusCodec, webrtc.RTPCodecTypeAudio)
+	if err == nil {
+		err = m.RegisterCodec(h264Codec, webrtc.RTPCodecTypeVideo)
+	}
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m))
+
+	var peerConnection *webrtc.PeerConnection
+	if err == nil {
+		peerConnection, err = api.NewPeerConnection(pcConfig)
+	}
+	if err != nil {
+		conn.Close()
+		if audioCodec != nil {
+			transform.Close()
+		}
+		return nil, err
+	}
 
 	streamer := &RtmpStreamer{}
 	streamer.pc = peerConnection
-	streamer.audioTrack = audioTrack
-	streamer.videoTrack = videoTrack
+	streamer.conn = conn
+	streamer.streams = streams
+	streamer.videoCodec = videoCodec
+	streamer.audioCodec = audioCodec
+	streamer.profile = profile
+	streamer.filter = filter
 	streamer.streamURL = streamURL
 	streamer.transform = transform
 
+	streamID := uuid.NewV4().String()
+
+	if audioCodec != nil {
+		streamer.audioTrack, err = webrtc.NewTrackLocalStaticSample(opusCodec.RTPCodecCapability, uuid.NewV4().String(), streamID)
+		if err == nil {
+			_, err = peerConnection.AddTransceiverFromTrack(streamer.audioTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		}
+		if err != nil {
+			streamer.Close()
+			return nil, err
+		}
+	}
+
+	if videoCodec != nil {
+		streamer.videoTrack, err = webrtc.NewTrackLocalStaticSample(h264Codec.RTPCodecCapability, uuid.NewV4().String(), streamID)
+		if err == nil {
+			_, err = peerConnection.AddTransceiverFromTrack(streamer.videoTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		}
+		if err != nil {
+			streamer.Close()
+			return nil, err
+		}
+	}
+
 	peerConnection.OnConnectionStateChange(streamer.onConnectionState)
 
 	return streamer, nil
@@ -103,15 +182,29 @@ func (r *RtmpStreamer) GetLocalSDP(sdpType webrtc.SDPType) (string, error) {
 		} else {
 			sdp, err = r.pc.CreateAnswer(nil)
 		}
-		err = r.pc.SetLocalDescription(sdp)
-		r.localSDP = sdp.SDP
+		if err != nil {
+			return "", err
+		}
+		// the sdp carries the candidates, there is no trickle
+		gathered := webrtc.GatheringCompletePromise(r.pc)
+		if err = r.pc.SetLocalDescription(sdp); err != nil {
+			return "", err
+		}
+		<-gathered
+		r.localSDP = r.pc.LocalDescription().SDP
 	}
 
-	return r.localSDP, err
+	return r.localSDP, nil
 }
 
 func (r *RtmpStreamer) SetRemoteSDP(sdpStr string, sdpType webrtc.SDPType) error {
 
+	if r.profile != nil {
+		if err := checkH264Profile(sdpStr, sdpType, *r.profile, false); err != nil {
+			return err
+		}
+	}
+
 	r.remoteSDP = sdpStr
 	sdp := webrtc.SessionDescription{SDP: sdpStr, Type: sdpType}
 	err := r.pc.SetRemoteDescription(sdp)
@@ -120,6 +213,11 @@ func (r *RtmpStreamer) SetRemoteSDP(sdpStr string, sdpType webrtc.SDPType) error
 }
 
 
+// Kinds reports the tracks of the source, the streamer only sends those.
+func (r *RtmpStreamer) Kinds() []webrtc.RTPCodecType {
+	return sourceKinds(r.videoCodec, r.audioCodec)
+}
+
 func (r *RtmpStreamer) onConnectionState(state webrtc.PeerConnectionState) {
 
 	if state == webrtc.PeerConnectionStateConnected {
@@ -139,40 +237,15 @@ func (r *RtmpStreamer) Close() {
 
 	r.pc.Close()
 	r.conn.Close()
-	r.transform.Close()
+	// the transformer is only set up for audio sources
+	if r.audioCodec != nil {
+		r.transform.Close()
+	}
 }
 
 func (r *RtmpStreamer) PullStream() {
 
-	conn, err := rtmp.Dial(r.streamURL)
-
-	if err != nil {
-		panic(err)
-	}
-
-	r.conn = conn
-
-	r.streams, err = conn.Streams()
-
-	if err != nil {
-		panic(err)
-	}
-
-	for _, stream := range r.streams {
-		if stream.Type() == av.H264 {
-			r.videoCodec = stream.(h264.CodecData)
-		}
-		if stream.Type() == av.AAC {
-			r.audioCodec = stream.(aac.CodecData)
-			r.transform.SetInSampleRate(r.audioCodec.SampleRate())
-			r.transform.SetInChannelLayout(r.audioCodec.ChannelLayout())
-			r.transform.SetInSampleFormat(r.audioCodec.SampleFormat())
-			r.transform.SetOutChannelLayout(av.CH_STEREO)
-			r.transform.SetOutSampleRate(48000)
-			r.transform.SetOutSampleFormat(av.S16)
-			r.transform.Setup()
-		}
-	}
+	conn := r.conn
 
 	for {
 		packet, err := conn.ReadPacket()
@@ -183,44 +256,27 @@ func (r *RtmpStreamer) PullStream() {
 		stream := r.streams[packet.Idx]
 
 		if stream.Type().IsVideo() {
-			var samples uint32
-			if r.lastVideoTime == 0 {
-				samples = 0
-			} else {
-				samples = uint32(uint64(packet.Time-r.lastVideoTime) * 90000 / 1000000000)
+			var duration time.Duration
+			if r.lastVideoTime != 0 {
+				duration = packet.Time - r.lastVideoTime
 			}
 
-			var b bytes.Buffer
-			// todo  may check the sps and ppt packet
-			if packet.IsKeyFrame {
-				b.Write(naluHeader)
-				b.Write(r.videoCodec.SPS())
-				b.Write(naluHeader)
-				b.Write(r.videoCodec.PPS())
+			nalus, err := r.filter.Filter(packet.Data, packet.IsKeyFrame)
+			if err != nil {
+				log.Debug().Msgf("streamer %s drops video packet at %v: %v", r.streamURL, packet.Time, err)
+				continue
 			}
-
-			if packet.Data[0] == 0x00 && packet.Data[1] == 0x00 && packet.Data[2] == 0x00 && packet.Data[3] == 0x01 {
-				fmt.Println("0001 prefix")
-				b.Write(packet.Data)
-			} else {
-				nalus, _ := h264.SplitNALUs(packet.Data)
-				for _, nalu := range nalus {
-					b.Write(naluHeader)
-					b.Write(nalu)
-				}
+			if len(nalus) == 0 {
+				continue
 			}
 
-			packets := r.videoTrack.Packetizer().Packetize(b.Bytes(), samples)
-			for _, p := range packets {
-				err := r.videoTrack.WriteRTP(p)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			err = r.videoTrack.WriteSample(media.Sample{Data: bitstream.JoinAnnexB(nalus), Duration: duration})
+			if err != nil {
+				fmt.Println(err)
 			}
 			r.lastVideoTime = packet.Time
 
-		} else if stream.Type() == av.AAC {
+		} else if stream.Type().IsAudio() {
 
 			pkts,err := r.transform.Do(packet)
 			if err != nil {
@@ -229,17 +285,13 @@ func (r *RtmpStreamer) PullStream() {
 			}
 
 			for _,pkt := range pkts {
-				packets := r.audioTrack.Packetizer().Packetize(pkt.Data, 960)
-				for _, p := range packets {
-					err := r.audioTrack.WriteRTP(p)
-					if err != nil {
-						fmt.Println(err)
-						continue
-					}
+				err := r.audioTrack.WriteSample(media.Sample{Data: pkt.Data, Duration: opusDuration(pkt.Data)})
+				if err != nil {
+					fmt.Println(err)
+					continue
 				}
 
 				r.lastAudioTime = pkt.Time
-				//r.audioTrack.WriteSample(media.Sample{Data: pkt.Data, Samples: 960})
 			}
 		}
 	}
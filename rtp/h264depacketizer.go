@@ -25,6 +25,7 @@ func (self *H264Depacketizer) Depacket(packet []byte)  ([][]byte, bool) {
 		indicator := packet[0]
 		nalHeader := packet[1]
 		if (nalHeader & 0x80) == 0x80 {
+			self.fuaFrameBuffer = self.fuaFrameBuffer[:0]
 			self.fuaFrameBuffer = append(self.fuaFrameBuffer, (indicator&0xE0)|(nalHeader&0x1F))
 			self.fuaFrameBuffer = append(self.fuaFrameBuffer, packet[2:]...)
 			return nil,false
@@ -52,7 +53,7 @@ func (self *H264Depacketizer) Depacket(packet []byte)  ([][]byte, bool) {
 			idx = idx + 2
 			size = size - 2
 			if nal_size <= size {
-				frameBuffer := packet[idx : idx+nal_size-1]
+				frameBuffer := packet[idx : idx+nal_size]
 				frame := make([]byte,len(frameBuffer))
 				copy(frame,frameBuffer)
 				frames = append(frames, frame)
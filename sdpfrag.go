@@ -0,0 +1,192 @@
+package rtcrtmp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const SDPFragContentType = "application/trickle-ice-sdpfrag"
+
+type sdpPeer interface {
+	SetRemoteSDP(sdpStr string, sdpType webrtc.SDPType) error
+	GetLocalSDP(sdpType webrtc.SDPType) (string, error)
+	AddICECandidate(candidate webrtc.ICECandidateInit) error
+}
+
+// SDPFrag is the body of a trickle ice PATCH request, see RFC 8840.
+type SDPFrag struct {
+	Ufrag      string
+	Pwd        string
+	MediaName  string
+	Mid        string
+	Candidates []string
+	// EndOfCandidates tells that no more candidates follow
+	EndOfCandidates bool
+}
+
+func ParseSDPFrag(frag string) *SDPFrag {
+
+	f := &SDPFrag{}
+
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			f.Ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			f.Pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=mid:"):
+			if f.Mid == "" {
+				f.Mid = strings.TrimPrefix(line, "a=mid:")
+			}
+		case strings.HasPrefix(line, "m="):
+			if f.MediaName == "" {
+				f.MediaName = strings.TrimPrefix(line, "m=")
+			}
+		case strings.HasPrefix(line, "a=candidate:"):
+			f.Candidates = append(f.Candidates, strings.TrimPrefix(line, "a="))
+		case line == "a=end-of-candidates":
+			f.EndOfCandidates = true
+		}
+	}
+	return f
+}
+
+func (f *SDPFrag) String() string {
+
+	var b strings.Builder
+	if f.Ufrag != "" {
+		fmt.Fprintf(&b, "a=ice-ufrag:%s\r\n", f.Ufrag)
+	}
+	if f.Pwd != "" {
+		fmt.Fprintf(&b, "a=ice-pwd:%s\r\n", f.Pwd)
+	}
+	if f.MediaName != "" {
+		fmt.Fprintf(&b, "m=%s\r\n", f.MediaName)
+	}
+	if f.Mid != "" {
+		fmt.Fprintf(&b, "a=mid:%s\r\n", f.Mid)
+	}
+	for _, candidate := range f.Candidates {
+		fmt.Fprintf(&b, "a=%s\r\n", candidate)
+	}
+	if f.EndOfCandidates {
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	return b.String()
+}
+
+// ICECandidates converts the fragment candidates for AddICECandidate.
+func (f *SDPFrag) ICECandidates() []webrtc.ICECandidateInit {
+
+	candidates := []webrtc.ICECandidateInit{}
+	for _, candidate := range f.Candidates {
+		init := webrtc.ICECandidateInit{Candidate: candidate}
+		if f.Mid != "" {
+			mid := f.Mid
+			init.SDPMid = &mid
+		}
+		candidates = append(candidates, init)
+	}
+	return candidates
+}
+
+// IsICERestart reports whether the fragment carries new ice credentials
+// compared with the given remote sdp.
+func (f *SDPFrag) IsICERestart(remotesdp string) bool {
+	return f.Ufrag != "" && f.Ufrag != iceUfrag(remotesdp)
+}
+
+// applySDPFrag adds the fragment candidates to the current session. A
+// fragment with new ice credentials restarts ice, the remote sdp is offered
+// again with them and the answer credentials and candidates are returned,
+// trickled candidates return a nil fragment.
+func applySDPFrag(peer sdpPeer, remotesdp string, frag *SDPFrag) (*SDPFrag, error) {
+
+	var answer *SDPFrag
+
+	if frag.IsICERestart(remotesdp) {
+		if frag.Pwd == "" {
+			return nil, fmt.Errorf("ice restart without ice-pwd")
+		}
+
+		offer := restartSDP(remotesdp, frag.Ufrag, frag.Pwd)
+		if err := peer.SetRemoteSDP(offer, webrtc.SDPTypeOffer); err != nil {
+			return nil, err
+		}
+		local, err := peer.GetLocalSDP(webrtc.SDPTypeAnswer)
+		if err != nil {
+			return nil, err
+		}
+		answer = answerSDPFrag(local)
+	}
+
+	for _, candidate := range frag.ICECandidates() {
+		if err := peer.AddICECandidate(candidate); err != nil {
+			return nil, err
+		}
+	}
+	return answer, nil
+}
+
+// restartSDP replaces the ice credentials of a sdp and drops its candidates,
+// those belong to the previous ice session.
+func restartSDP(sdpstr string, ufrag string, pwd string) string {
+
+	var b strings.Builder
+	for _, line := range strings.Split(sdpstr, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// answerSDPFrag is the fragment of a bundled local sdp, every media section
+// repeats the same candidates.
+func answerSDPFrag(sdpstr string) *SDPFrag {
+
+	frag := ParseSDPFrag(sdpstr)
+
+	seen := map[string]bool{}
+	candidates := []string{}
+	for _, candidate := range frag.Candidates {
+		if !seen[candidate] {
+			seen[candidate] = true
+			candidates = append(candidates, candidate)
+		}
+	}
+	frag.Candidates = candidates
+	return frag
+}
+
+func iceUfrag(sdpstr string) string {
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(sdpstr)); err != nil {
+		return ""
+	}
+
+	if ufrag, ok := desc.Attribute("ice-ufrag"); ok {
+		return ufrag
+	}
+	for _, media := range desc.MediaDescriptions {
+		if ufrag, ok := media.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
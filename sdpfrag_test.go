@@ -0,0 +1,95 @@
+package rtcrtmp
+
+import (
+	"strings"
+	"testing"
+)
+
+const testCandidate = "candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host"
+
+func TestParseSDPFrag(t *testing.T) {
+
+	for _, test := range []struct {
+		name string
+		frag string
+		want SDPFrag
+	}{
+		{"trickle", "a=ice-ufrag:abc\r\na=ice-pwd:password\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=" + testCandidate + "\r\n",
+			SDPFrag{Ufrag: "abc", Pwd: "password", MediaName: "audio 9 UDP/TLS/RTP/SAVPF 111", Mid: "0", Candidates: []string{testCandidate}}},
+		{"bare newlines", "a=ice-ufrag:abc\na=mid:1\na=" + testCandidate + "\na=end-of-candidates\n",
+			SDPFrag{Ufrag: "abc", Mid: "1", Candidates: []string{testCandidate}, EndOfCandidates: true}},
+		{"first section names the fragment", "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\n",
+			SDPFrag{MediaName: "audio 9 UDP/TLS/RTP/SAVPF 111", Mid: "0"}},
+		{"credentials only", "a=ice-ufrag:new\r\na=ice-pwd:newpassword\r\n",
+			SDPFrag{Ufrag: "new", Pwd: "newpassword"}},
+		{"unknown lines", "a=group:BUNDLE 0\r\na=ice-options:trickle\r\n", SDPFrag{}},
+		{"empty", "", SDPFrag{}},
+	} {
+		got := ParseSDPFrag(test.frag)
+		if got.Ufrag != test.want.Ufrag || got.Pwd != test.want.Pwd || got.MediaName != test.want.MediaName || got.Mid != test.want.Mid ||
+			got.EndOfCandidates != test.want.EndOfCandidates || strings.Join(got.Candidates, "|") != strings.Join(test.want.Candidates, "|") {
+			t.Fatalf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSDPFragEndOfCandidates(t *testing.T) {
+
+	for _, test := range []struct {
+		frag SDPFrag
+		want string
+	}{
+		{SDPFrag{Mid: "0", Candidates: []string{testCandidate}}, "a=mid:0\r\na=" + testCandidate + "\r\n"},
+		{SDPFrag{Mid: "0", Candidates: []string{testCandidate}, EndOfCandidates: true}, "a=mid:0\r\na=" + testCandidate + "\r\na=end-of-candidates\r\n"},
+		{SDPFrag{Mid: "0", EndOfCandidates: true}, "a=mid:0\r\na=end-of-candidates\r\n"},
+	} {
+		got := test.frag.String()
+		if got != test.want {
+			t.Fatalf("got %q, want %q", got, test.want)
+		}
+		parsed := ParseSDPFrag(got)
+		if parsed.EndOfCandidates != test.frag.EndOfCandidates || len(parsed.Candidates) != len(test.frag.Candidates) {
+			t.Fatalf("%q parsed end-of-candidates %v with %d candidates", got, parsed.EndOfCandidates, len(parsed.Candidates))
+		}
+	}
+}
+
+func TestRestartSDP(t *testing.T) {
+
+	remote := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=ice-ufrag:old\r\n" +
+		"a=ice-pwd:oldpassword\r\n" +
+		"a=" + testCandidate + "\r\n" +
+		"a=end-of-candidates\r\n" +
+		"a=mid:0\r\n"
+
+	restarted := restartSDP(remote, "new", "newpassword")
+
+	want := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=ice-ufrag:new\r\n" +
+		"a=ice-pwd:newpassword\r\n" +
+		"a=mid:0\r\n"
+	if restarted != want {
+		t.Fatalf("got %q, want %q", restarted, want)
+	}
+	if !ParseSDPFrag("a=ice-ufrag:new\r\n").IsICERestart(remote) || ParseSDPFrag("a=ice-ufrag:old\r\n").IsICERestart(remote) {
+		t.Fatal("restart detection")
+	}
+}
+
+func TestAnswerSDPFragBundle(t *testing.T) {
+
+	local := "v=0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=ice-ufrag:abc\r\na=ice-pwd:password\r\na=mid:0\r\na=" + testCandidate + "\r\na=end-of-candidates\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=ice-ufrag:abc\r\na=ice-pwd:password\r\na=mid:1\r\na=" + testCandidate + "\r\na=end-of-candidates\r\n"
+
+	frag := answerSDPFrag(local)
+	if frag.Ufrag != "abc" || frag.Pwd != "password" || frag.Mid != "0" || !strings.HasPrefix(frag.MediaName, "audio") {
+		t.Fatalf("answer fragment %+v", frag)
+	}
+	if len(frag.Candidates) != 1 || !frag.EndOfCandidates {
+		t.Fatalf("%d candidates, end-of-candidates %v", len(frag.Candidates), frag.EndOfCandidates)
+	}
+}
@@ -0,0 +1,65 @@
+package signaling
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// Message types, the same json object is used in both directions.
+//
+//	subscribe    client  {stream, sdp?,   server creates a subscription and
+//	                     serveroffer?,    replies a "subscribed" event, with an
+//	                     kinds?}          answer when the offer is inlined or
+//	                                      with its own offer for serveroffer
+//	subscribe    client  {id, stream,     add a stream to the PeerConnection of
+//	                     kinds?}          an existing subscription
+//	unsubscribe  client  {id, stream?}    stop the subscription, or only one
+//	                                      of its streams
+//	switch       client  {id, from,       move the tracks of stream from to
+//	                     stream}          stream, answered by a "switched"
+//	                                      event
+//	offer        both    {id, sdp}        first offer or renegotiation, sent by
+//	                                      the server for serveroffer
+//	                                      subscriptions
+//	answer       both    {id, sdp}        answer to the offer
+//	candidate    both    {id, candidate}  trickle candidate, an empty
+//	                                      candidate ends gathering
+//	event        server  {id?, event, data?}
+//
+// kinds lists "audio" and/or "video", both when empty.
+//
+// Every stream of a subscription has its own track pair, the "subscribed"
+// event carries their msid as data. Adding or removing a stream renegotiates,
+// the server sends a new offer for serveroffer subscriptions and a
+// "negotiationneeded" event otherwise.
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeSwitch      = "switch"
+	TypeOffer       = "offer"
+	TypeAnswer      = "answer"
+	TypeCandidate   = "candidate"
+	TypeEvent       = "event"
+)
+
+// Events pushed by the server, connection states are sent as their
+// webrtc.PeerConnectionState string.
+const (
+	EventSubscribed        = "subscribed"
+	EventUnsubscribed      = "unsubscribed"
+	EventSwitched          = "switched"
+	EventNegotiationNeeded = "negotiationneeded"
+	EventError             = "error"
+)
+
+type Message struct {
+	Type        string                   `json:"type"`
+	ID          string                   `json:"id,omitempty"`
+	Stream      string                   `json:"stream,omitempty"`
+	From        string                   `json:"from,omitempty"`
+	SDP         string                   `json:"sdp,omitempty"`
+	Candidate   *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Event       string                   `json:"event,omitempty"`
+	Data        interface{}              `json:"data,omitempty"`
+	ServerOffer bool                     `json:"serveroffer,omitempty"`
+	Kinds       []string                 `json:"kinds,omitempty"`
+}
@@ -0,0 +1,144 @@
+package signaling
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	rtcrtmp "github.com/notedit/rtc-rtmp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// Server upgrades http requests to websocket signaling sessions. One router
+// is shared by all subscribers of a stream and stopped with the last one.
+type Server struct {
+	endpoint  string
+	streamURL func(stream string) string
+	upgrader  websocket.Upgrader
+
+	routers map[string]*rtcrtmp.RTCRouter
+	sync.RWMutex
+}
+
+// NewServer creates a signaling server, streamURL maps the stream name of a
+// subscribe message to the rtmp url the router pulls.
+func NewServer(endpoint string, streamURL func(stream string) string) *Server {
+
+	return &Server{
+		endpoint:  endpoint,
+		streamURL: streamURL,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		routers: make(map[string]*rtcrtmp.RTCRouter),
+	}
+}
+
+// SetCheckOrigin replaces the default check, which accepts every origin.
+func (self *Server) SetCheckOrigin(f func(r *http.Request) bool) {
+	self.upgrader.CheckOrigin = f
+}
+
+func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	conn, err := self.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debug().Msgf("signaling upgrade error %v", err)
+		return
+	}
+
+	session := newSession(self, conn)
+	session.run()
+}
+
+// subscribe adds the stream to transport, or to a new transport when it is
+// nil.
+func (self *Server) subscribe(stream string, transport *rtcrtmp.RTCTransport, kinds []webrtc.RTPCodecType) (*rtcrtmp.RTCRouter, *rtcrtmp.RTCTransport, error) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	router, err := self.router(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if transport != nil {
+		if err := router.AddSubscriber(transport, kinds...); err != nil {
+			return nil, nil, err
+		}
+		return router, transport, nil
+	}
+
+	transport, err = router.CreateSubscriber(kinds...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return router, transport, nil
+}
+
+// switchSubscriber moves transport from the router of one stream to the
+// router of another, see RTCRouter.SwitchSubscriber.
+func (self *Server) switchSubscriber(from string, router *rtcrtmp.RTCRouter, to string, transport *rtcrtmp.RTCTransport) (*rtcrtmp.RTCRouter, error) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	next, err := self.router(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = router.SwitchSubscriber(transport, next); err != nil {
+		if next.SubscriberCount() == 0 {
+			next.Stop()
+			delete(self.routers, to)
+		}
+		return nil, err
+	}
+
+	if router.SubscriberCount() == 0 && self.routers[from] == router {
+		router.Stop()
+		delete(self.routers, from)
+	}
+	return next, nil
+}
+
+// router returns the router of stream and creates it on first use, the
+// caller holds the lock.
+func (self *Server) router(stream string) (*rtcrtmp.RTCRouter, error) {
+
+	// a router that stopped on its own is replaced by a new one
+	if router, ok := self.routers[stream]; ok && router.Err() == nil {
+		return router, nil
+	}
+
+	streamURL := self.streamURL(stream)
+	if streamURL == "" {
+		return nil, fmt.Errorf("stream %s does not exist", stream)
+	}
+
+	router, err := rtcrtmp.NewRTCRouter(streamURL, self.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	self.routers[stream] = router
+	return router, nil
+}
+
+// unsubscribe removes the stream from transport and stops the router with
+// its last subscriber.
+func (self *Server) unsubscribe(stream string, router *rtcrtmp.RTCRouter, transport *rtcrtmp.RTCTransport) {
+
+	router.StopSubscriber(transport)
+
+	self.Lock()
+	defer self.Unlock()
+
+	if router.SubscriberCount() == 0 && self.routers[stream] == router {
+		router.Stop()
+		delete(self.routers, stream)
+	}
+}
@@ -0,0 +1,475 @@
+package signaling
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	rtcrtmp "github.com/notedit/rtc-rtmp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// subscription is one PeerConnection, it carries a track pair for every
+// subscribed stream.
+type subscription struct {
+	transport *rtcrtmp.RTCTransport
+	routers   map[string]*rtcrtmp.RTCRouter
+
+	// candidates gathered before the local description went out, a client
+	// can not add them before it has the remote description
+	described bool
+	pending   []*Message
+
+	// server offered subscriptions renegotiate one offer at a time
+	serverOffer bool
+	offering    bool
+	renegotiate bool
+	sync.Mutex
+}
+
+// Session is one websocket connection, it owns every subscription created
+// on it and stops them when the socket closes.
+type Session struct {
+	server *Server
+	conn   *websocket.Conn
+
+	writeLock     sync.Mutex
+	subscriptions map[string]*subscription
+	sync.RWMutex
+}
+
+func newSession(server *Server, conn *websocket.Conn) *Session {
+
+	return &Session{
+		server:        server,
+		conn:          conn,
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// Send writes a message to the client, safe for concurrent use.
+func (self *Session) Send(msg *Message) error {
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	return self.conn.WriteJSON(msg)
+}
+
+// Event pushes a server event, id is empty for session wide events.
+func (self *Session) Event(id string, event string, data interface{}) error {
+	return self.Send(&Message{Type: TypeEvent, ID: id, Event: event, Data: data})
+}
+
+func (self *Session) run() {
+
+	defer self.close()
+
+	for {
+		msg := &Message{}
+		if err := self.conn.ReadJSON(msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debug().Msgf("signaling read error %v", err)
+			}
+			return
+		}
+
+		if err := self.handleMessage(msg); err != nil {
+			log.Debug().Msgf("signaling %s %s error %v", msg.Type, msg.ID, err)
+			self.Event(msg.ID, EventError, err.Error())
+		}
+	}
+}
+
+func (self *Session) handleMessage(msg *Message) error {
+
+	switch msg.Type {
+	case TypeSubscribe:
+		return self.subscribe(msg)
+	case TypeUnsubscribe:
+		return self.unsubscribe(msg)
+	case TypeSwitch:
+		return self.switchStream(msg)
+	case TypeOffer:
+		return self.offer(msg.ID, msg.SDP)
+	case TypeAnswer:
+		return self.answer(msg.ID, msg.SDP)
+	case TypeCandidate:
+		return self.candidate(msg.ID, msg.Candidate)
+	default:
+		return fmt.Errorf("unknown message type %q", msg.Type)
+	}
+}
+
+func (self *Session) subscribe(msg *Message) error {
+
+	if msg.Stream == "" {
+		return fmt.Errorf("subscribe without stream")
+	}
+
+	kinds, err := mediaKinds(msg.Kinds)
+	if err != nil {
+		return err
+	}
+
+	if msg.ID != "" {
+		return self.addStream(msg.ID, msg.Stream, kinds)
+	}
+
+	router, transport, err := self.server.subscribe(msg.Stream, nil, kinds)
+	if err != nil {
+		return err
+	}
+
+	id := transport.ID()
+	sub := &subscription{
+		transport:   transport,
+		routers:     map[string]*rtcrtmp.RTCRouter{msg.Stream: router},
+		serverOffer: msg.ServerOffer,
+	}
+
+	err = transport.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		out := &Message{Type: TypeCandidate, ID: id}
+		if candidate != nil {
+			init := candidate.ToJSON()
+			out.Candidate = &init
+		}
+		self.sendCandidate(sub, out)
+	})
+	if err != nil {
+		self.stopSubscription(sub)
+		return err
+	}
+
+	transport.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		self.Event(id, state.String(), nil)
+	})
+
+	// streams added or removed later need a new offer. The server calls the
+	// router with its lock held, so the websocket write runs on its own.
+	transport.OnNegotiationNeeded(func() {
+		go func() {
+			if !sub.serverOffer {
+				self.Event(id, EventNegotiationNeeded, nil)
+				return
+			}
+			if err := self.sendOffer(id); err != nil {
+				log.Debug().Msgf("signaling renegotiate %s error %v", id, err)
+			}
+		}()
+	})
+
+	self.Lock()
+	self.subscriptions[id] = sub
+	self.Unlock()
+
+	if err = self.subscribed(id, msg.Stream, transport.StreamID(router)); err != nil {
+		return err
+	}
+
+	if sub.serverOffer {
+		return self.sendOffer(id)
+	}
+
+	if msg.SDP == "" {
+		return nil
+	}
+	return self.offer(id, msg.SDP)
+}
+
+// addStream subscribes one more stream on the PeerConnection of id.
+func (self *Session) addStream(id string, stream string, kinds []webrtc.RTPCodecType) error {
+
+	sub, err := self.subscription(id)
+	if err != nil {
+		return err
+	}
+
+	sub.Lock()
+	_, ok := sub.routers[stream]
+	sub.Unlock()
+
+	if ok {
+		return fmt.Errorf("subscription %s already has stream %s", id, stream)
+	}
+
+	router, _, err := self.server.subscribe(stream, sub.transport, kinds)
+	if err != nil {
+		return err
+	}
+
+	sub.Lock()
+	sub.routers[stream] = router
+	sub.Unlock()
+
+	return self.subscribed(id, stream, sub.transport.StreamID(router))
+}
+
+// subscribed tells the client the msid of the stream's tracks.
+func (self *Session) subscribed(id string, stream string, msid string) error {
+	return self.Send(&Message{Type: TypeEvent, ID: id, Stream: stream, Event: EventSubscribed, Data: msid})
+}
+
+func (self *Session) unsubscribe(msg *Message) error {
+
+	sub, err := self.subscription(msg.ID)
+	if err != nil {
+		return err
+	}
+
+	if msg.Stream == "" {
+		self.Lock()
+		delete(self.subscriptions, msg.ID)
+		self.Unlock()
+
+		self.stopSubscription(sub)
+		return self.Event(msg.ID, EventUnsubscribed, nil)
+	}
+
+	sub.Lock()
+	router := sub.routers[msg.Stream]
+	delete(sub.routers, msg.Stream)
+	sub.Unlock()
+
+	if router == nil {
+		return fmt.Errorf("subscription %s does not have stream %s", msg.ID, msg.Stream)
+	}
+
+	self.server.unsubscribe(msg.Stream, router, sub.transport)
+	return self.Send(&Message{Type: TypeEvent, ID: msg.ID, Stream: msg.Stream, Event: EventUnsubscribed})
+}
+
+// switchStream replaces a stream of the subscription by another one on the
+// same tracks, no renegotiation is needed.
+func (self *Session) switchStream(msg *Message) error {
+
+	sub, err := self.subscription(msg.ID)
+	if err != nil {
+		return err
+	}
+
+	if msg.Stream == "" || msg.From == "" {
+		return fmt.Errorf("switch needs stream and from")
+	}
+
+	sub.Lock()
+	router := sub.routers[msg.From]
+	_, exists := sub.routers[msg.Stream]
+	sub.Unlock()
+
+	if router == nil {
+		return fmt.Errorf("subscription %s does not have stream %s", msg.ID, msg.From)
+	}
+	if exists {
+		return fmt.Errorf("subscription %s already has stream %s", msg.ID, msg.Stream)
+	}
+
+	next, err := self.server.switchSubscriber(msg.From, router, msg.Stream, sub.transport)
+	if err != nil {
+		return err
+	}
+
+	sub.Lock()
+	delete(sub.routers, msg.From)
+	sub.routers[msg.Stream] = next
+	sub.Unlock()
+
+	return self.Send(&Message{Type: TypeEvent, ID: msg.ID, Stream: msg.Stream, From: msg.From, Event: EventSwitched})
+}
+
+// stopSubscription closes the PeerConnection before its streams are removed,
+// so they do not trigger a renegotiation.
+func (self *Session) stopSubscription(sub *subscription) {
+
+	sub.transport.Stop()
+
+	sub.Lock()
+	routers := sub.routers
+	sub.routers = make(map[string]*rtcrtmp.RTCRouter)
+	sub.Unlock()
+
+	for stream, router := range routers {
+		self.server.unsubscribe(stream, router, sub.transport)
+	}
+}
+
+// offer handles the first offer as well as renegotiation and ice restart,
+// every offer gets a fresh answer.
+func (self *Session) offer(id string, sdpstr string) error {
+
+	sub, err := self.subscription(id)
+	if err != nil {
+		return err
+	}
+
+	if sub.serverOffer {
+		return fmt.Errorf("subscription %s is offered by the server", id)
+	}
+
+	sub.Lock()
+	sub.described = false
+	sub.Unlock()
+
+	if err = sub.transport.SetRemoteSDP(sdpstr, webrtc.SDPTypeOffer); err != nil {
+		return err
+	}
+
+	answer, err := sub.transport.GetLocalSDP(webrtc.SDPTypeAnswer)
+	if err != nil {
+		return err
+	}
+
+	return self.sendDescription(sub, &Message{Type: TypeAnswer, ID: id, SDP: answer})
+}
+
+// sendOffer starts a server side negotiation, while an offer waits for its
+// answer a new one is only scheduled.
+func (self *Session) sendOffer(id string) error {
+
+	sub, err := self.subscription(id)
+	if err != nil {
+		return err
+	}
+
+	sub.Lock()
+	if sub.offering {
+		sub.renegotiate = true
+		sub.Unlock()
+		return nil
+	}
+	sub.offering = true
+	sub.described = false
+	sub.Unlock()
+
+	offer, err := sub.transport.CreateOffer()
+	if err != nil {
+		sub.Lock()
+		sub.offering = false
+		sub.Unlock()
+		return err
+	}
+
+	return self.sendDescription(sub, &Message{Type: TypeOffer, ID: id, SDP: offer})
+}
+
+func (self *Session) answer(id string, sdpstr string) error {
+
+	sub, err := self.subscription(id)
+	if err != nil {
+		return err
+	}
+
+	sub.Lock()
+	offering := sub.offering
+	sub.Unlock()
+
+	if !offering {
+		return fmt.Errorf("subscription %s has no pending offer", id)
+	}
+
+	err = sub.transport.SetRemoteSDP(sdpstr, webrtc.SDPTypeAnswer)
+
+	sub.Lock()
+	sub.offering = false
+	renegotiate := sub.renegotiate
+	sub.renegotiate = false
+	sub.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if renegotiate {
+		return self.sendOffer(id)
+	}
+	return nil
+}
+
+// sendDescription sends an offer or answer and then the candidates gathered
+// while it was created.
+func (self *Session) sendDescription(sub *subscription, msg *Message) error {
+
+	if err := self.Send(msg); err != nil {
+		return err
+	}
+
+	sub.Lock()
+	sub.described = true
+	pending := sub.pending
+	sub.pending = nil
+	sub.Unlock()
+
+	for _, msg := range pending {
+		if err := self.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *Session) candidate(id string, candidate *webrtc.ICECandidateInit) error {
+
+	sub, err := self.subscription(id)
+	if err != nil {
+		return err
+	}
+
+	// end of candidates, nothing to do for an ice-lite server
+	if candidate == nil || candidate.Candidate == "" {
+		return nil
+	}
+	return sub.transport.AddICECandidate(*candidate)
+}
+
+func (self *Session) sendCandidate(sub *subscription, msg *Message) {
+
+	sub.Lock()
+	if !sub.described {
+		sub.pending = append(sub.pending, msg)
+		sub.Unlock()
+		return
+	}
+	sub.Unlock()
+
+	if err := self.Send(msg); err != nil {
+		log.Debug().Msgf("signaling send candidate error %v", err)
+	}
+}
+
+func (self *Session) subscription(id string) (*subscription, error) {
+
+	self.RLock()
+	sub := self.subscriptions[id]
+	self.RUnlock()
+
+	if sub == nil {
+		return nil, fmt.Errorf("subscription %s does not exist", id)
+	}
+	return sub, nil
+}
+
+func (self *Session) close() {
+
+	self.Lock()
+	subscriptions := self.subscriptions
+	self.subscriptions = make(map[string]*subscription)
+	self.Unlock()
+
+	for _, sub := range subscriptions {
+		self.stopSubscription(sub)
+	}
+	self.conn.Close()
+}
+
+func mediaKinds(names []string) ([]webrtc.RTPCodecType, error) {
+
+	kinds := []webrtc.RTPCodecType{}
+	for _, name := range names {
+		kind := webrtc.NewRTPCodecType(name)
+		if kind == 0 {
+			return nil, fmt.Errorf("unknown media kind %q", name)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
@@ -0,0 +1,33 @@
+package rtcrtmp
+
+import (
+	"github.com/notedit/rtc-rtmp/bitstream"
+	"github.com/rs/zerolog/log"
+)
+
+// singleNALPayloader packetizes for packetization-mode 0, every nal unit of
+// the access unit is one packet. Nal units over the mtu can not be split in
+// this mode, a receiver would drop the oversized packet anyway, so they are
+// dropped here and reported once per stream.
+type singleNALPayloader struct {
+	streamID string
+	reported bool
+}
+
+func (self *singleNALPayloader) Payload(mtu uint16, payload []byte) [][]byte {
+
+	nalus := bitstream.SplitAnnexB(payload)
+
+	payloads := make([][]byte, 0, len(nalus))
+	for _, nalu := range nalus {
+		if len(nalu) > int(mtu) {
+			if !self.reported {
+				self.reported = true
+				log.Debug().Msgf("router %s drops nalu type %d of %d bytes over the mtu %d in packetization-mode 0, later ones are not reported", self.streamID, nalu[0]&0x1f, len(nalu), mtu)
+			}
+			continue
+		}
+		payloads = append(payloads, nalu)
+	}
+	return payloads
+}
@@ -0,0 +1,40 @@
+package rtcrtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/notedit/rtc-rtmp/bitstream"
+)
+
+func TestSingleNALPayloaderDropsOversized(t *testing.T) {
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	small := append([]byte{0x41}, bytes.Repeat([]byte{0x9a}, 100)...)
+	large := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 1500)...)
+
+	payloader := &singleNALPayloader{streamID: "test"}
+	for _, test := range []struct {
+		nalus [][]byte
+		want  [][]byte
+	}{
+		{[][]byte{sps, pps, small}, [][]byte{sps, pps, small}},
+		{[][]byte{sps, pps, large}, [][]byte{sps, pps}},
+		// reported once, dropped every time
+		{[][]byte{large}, [][]byte{}},
+	} {
+		payloads := payloader.Payload(1200, bitstream.JoinAnnexB(test.nalus))
+		if len(payloads) != len(test.want) {
+			t.Fatalf("%d payloads, want %d", len(payloads), len(test.want))
+		}
+		for i := range test.want {
+			if !bytes.Equal(payloads[i], test.want[i]) {
+				t.Fatalf("payload %d is type %d", i, payloads[i][0]&0x1f)
+			}
+		}
+	}
+	if !payloader.reported {
+		t.Fatal("oversized nalu not reported")
+	}
+}
@@ -0,0 +1,136 @@
+package rtcrtmp
+
+import (
+	"fmt"
+
+	"github.com/notedit/rtc-rtmp/bitstream"
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/h264"
+	"github.com/pion/webrtc/v3"
+)
+
+// sourceCodecs picks the H264 and audio streams of an rtmp source, the audio
+// is anything ffmpeg can decode for the opus transcoding. A missing stream is
+// nil, a stream in any other codec is an error, so a session never starts
+// silent or black.
+func sourceCodecs(streams []av.CodecData) (video *h264.CodecData, audio av.AudioCodecData, err error) {
+
+	for _, stream := range streams {
+		switch {
+		case stream.Type() == av.H264:
+			codec := stream.(h264.CodecData)
+			video = &codec
+		case stream.Type().IsAudio():
+			codec, ok := stream.(av.AudioCodecData)
+			if _, known := trans.DecoderName(stream.Type()); !ok || !known {
+				return nil, nil, fmt.Errorf("unsupported audio codec %s", codecName(stream.Type()))
+			}
+			audio = codec
+		default:
+			return nil, nil, fmt.Errorf("unsupported video codec %s", codecName(stream.Type()))
+		}
+	}
+
+	if video == nil && audio == nil {
+		return nil, nil, fmt.Errorf("source has neither audio nor video")
+	}
+	return video, audio, nil
+}
+
+// Config tunes routers and streamers, the zero value is what NewRTCRouter
+// and NewRtmpStreamer use.
+type Config struct {
+	// Opus configures the opus transcoding, music and voice streams
+	// want very different settings
+	Opus trans.OpusConfig
+	// Loudness normalizes, amplifies or limits the source audio for all
+	// the encodings
+	Loudness trans.LoudnessConfig
+}
+
+func (config Config) validate() error {
+
+	if err := config.Opus.Validate(); err != nil {
+		return err
+	}
+	return config.Loudness.Validate()
+}
+
+// setupTransform prepares the opus transcoding of the source audio.
+func setupTransform(transform *trans.Transformer, codec av.AudioCodecData, config Config) error {
+
+	if err := transform.SetOpusConfig(config.Opus); err != nil {
+		return err
+	}
+	if err := transform.SetLoudnessConfig(config.Loudness); err != nil {
+		return err
+	}
+	if err := transform.SetInCodecData(codec); err != nil {
+		return err
+	}
+	transform.SetOutSampleRate(48000)
+	transform.SetOutSampleFormat(av.S16)
+	return transform.Setup()
+}
+
+// setupMultiopusTransform prepares the opus multistream transcoding, the
+// encoder keeps the channels of the source.
+func setupMultiopusTransform(transform *trans.Transformer, codec av.AudioCodecData, config Config) error {
+
+	if err := transform.SetOpusConfig(config.Opus); err != nil {
+		return err
+	}
+	if err := transform.SetLoudnessConfig(config.Loudness); err != nil {
+		return err
+	}
+	if err := transform.SetInCodecData(codec); err != nil {
+		return err
+	}
+	transform.SetOutChannelLayout(codec.ChannelLayout())
+	transform.SetOutSampleRate(48000)
+	transform.SetOutSampleFormat(av.S16)
+	return transform.Setup()
+}
+
+// multichannel tells if the source audio gets a multiopus variant.
+func multichannel(codec av.AudioCodecData, config Config) bool {
+
+	if codec == nil || !config.Opus.Multistream {
+		return false
+	}
+	_, ok := trans.OpusSurroundMapping(codec.ChannelLayout().Count())
+	return ok
+}
+
+// videoFilter normalizes the h264 packets of the source to access units
+// with their parameter sets in front of every keyframe.
+func videoFilter(codec *h264.CodecData) *bitstream.Filter {
+
+	record := codec.RecordInfo
+	return bitstream.NewFilter(record.SPS, record.PPS, int(record.LengthSizeMinusOne)+1)
+}
+
+// sourceKinds lists the media kinds of the source codecs.
+func sourceKinds(video *h264.CodecData, audio av.AudioCodecData) []webrtc.RTPCodecType {
+
+	kinds := []webrtc.RTPCodecType{}
+	if audio != nil {
+		kinds = append(kinds, webrtc.RTPCodecTypeAudio)
+	}
+	if video != nil {
+		kinds = append(kinds, webrtc.RTPCodecTypeVideo)
+	}
+	return kinds
+}
+
+func codecName(codecType av.CodecType) string {
+
+	if codecType == trans.MP3 {
+		return "MP3"
+	}
+	if name := codecType.String(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("0x%x", uint32(codecType))
+}
@@ -0,0 +1,306 @@
+package rtcrtmp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	rtputil "github.com/notedit/rtc-rtmp/rtp"
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	naluTypeSTAPA = 24
+	naluTypeFUA   = 28
+)
+
+// rtcTrack is one outgoing track, packets from the router are rewritten to
+// its own ssrc so tracks of different routers never collide. Sequence numbers
+// and timestamps are rewritten as well, so the track stays continuous when it
+// switches to another router.
+type rtcTrack struct {
+	id          string
+	ssrc        uint32
+	kind        webrtc.RTPCodecType
+	track       *localTrack
+	transceiver *webrtc.RTPTransceiver
+	buffer      *rtputil.RTPBuffer
+
+	// payload type negotiated with the remote side, router packets carry
+	// the default one
+	payloadType uint8
+	// audio codec of the track, G.711 runs at 8kHz
+	encoding audioEncoding
+
+	// router ssrc of the last packet, its sync point maps the timestamps
+	source uint32
+	// sender report counts, payload octets without headers
+	packetCount uint32
+	octetCount  uint32
+
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastTime  time.Time
+	started   bool
+	// samples of the last audio packet
+	lastSamples uint32
+
+	// rebase continues after the last sent packet, waitKeyFrame drops video
+	// until the next keyframe
+	rebase       bool
+	waitKeyFrame bool
+
+	// keyFrameOnly forwards only keyframe access units, muted drops all
+	keyFrameOnly bool
+	inKeyFrame   bool
+	muted        bool
+	sync.Mutex
+}
+
+// localTrack is the pion side of an rtcTrack. The packets are rewritten
+// already, so they go out as they are with the payload type the transport
+// negotiated for the track.
+type localTrack struct {
+	id       string
+	streamID string
+	kind     webrtc.RTPCodecType
+	writer   webrtc.TrackLocalWriter
+	sync.RWMutex
+}
+
+func (self *localTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+
+	codecs := ctx.CodecParameters()
+	if len(codecs) == 0 {
+		return webrtc.RTPCodecParameters{}, fmt.Errorf("track %s has no negotiated codec", self.id)
+	}
+
+	self.Lock()
+	self.writer = ctx.WriteStream()
+	self.Unlock()
+	return codecs[0], nil
+}
+
+func (self *localTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+
+	self.Lock()
+	self.writer = nil
+	self.Unlock()
+	return nil
+}
+
+func (self *localTrack) ID() string {
+	return self.id
+}
+
+func (self *localTrack) RID() string {
+	return ""
+}
+
+func (self *localTrack) StreamID() string {
+	return self.streamID
+}
+
+func (self *localTrack) Kind() webrtc.RTPCodecType {
+	return self.kind
+}
+
+// WriteRTP drops the packet until the track is bound.
+func (self *localTrack) WriteRTP(packet *rtp.Packet) error {
+
+	self.RLock()
+	writer := self.writer
+	self.RUnlock()
+
+	if writer == nil {
+		return nil
+	}
+	_, err := writer.WriteRTP(&packet.Header, packet.Payload)
+	return err
+}
+
+func (self *rtcTrack) clockRate() uint32 {
+	if self.kind == webrtc.RTPCodecTypeVideo {
+		return 90000
+	}
+	if self.encoding.isG711() {
+		return trans.G711SampleRate
+	}
+	return 48000
+}
+
+// frameDuration is the smallest timestamp step after a rebase, one 30fps
+// frame or the last audio packet, 20ms before the first.
+func (self *rtcTrack) frameDuration() uint32 {
+	if self.kind == webrtc.RTPCodecTypeVideo {
+		return 3000
+	}
+	if self.lastSamples != 0 {
+		return self.lastSamples
+	}
+	return self.clockRate() / 50
+}
+
+func (self *rtcTrack) setPayloadType(payloadType uint8) {
+
+	self.Lock()
+	self.payloadType = payloadType
+	self.Unlock()
+}
+
+// setEncoding changes the audio codec of the track, it reports a change.
+func (self *rtcTrack) setEncoding(encoding audioEncoding) bool {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.encoding == encoding {
+		return false
+	}
+	self.encoding = encoding
+	self.lastSamples = 0
+	return true
+}
+
+// switched prepares the track for packets of another router.
+func (self *rtcTrack) switched() {
+
+	self.Lock()
+	self.rebase = true
+	self.waitKeyFrame = self.kind == webrtc.RTPCodecTypeVideo
+	self.Unlock()
+}
+
+// setKeyFrameOnly switches between keyframes only and all frames, full frame
+// rate resumes with the next keyframe.
+func (self *rtcTrack) setKeyFrameOnly(keyFrameOnly bool) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.keyFrameOnly == keyFrameOnly {
+		return
+	}
+	self.keyFrameOnly = keyFrameOnly
+	self.inKeyFrame = false
+	if !keyFrameOnly {
+		self.rebase = true
+		self.waitKeyFrame = true
+	}
+}
+
+func (self *rtcTrack) setMuted(muted bool) {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.muted == muted {
+		return
+	}
+	self.muted = muted
+	if !muted {
+		self.rebase = true
+	}
+}
+
+// rewrite returns the packet as it goes out on this track, or nil when it has
+// to be dropped. The router packet is shared, so a copy is returned.
+func (self *rtcTrack) rewrite(packet *rtp.Packet) *rtp.Packet {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.muted {
+		return nil
+	}
+
+	if self.keyFrameOnly {
+		if !self.inKeyFrame && !isKeyFrameStart(packet.Payload) {
+			// dropped packets do not leave sequence gaps
+			self.seqOffset--
+			return nil
+		}
+		self.inKeyFrame = !packet.Marker
+	}
+
+	if self.waitKeyFrame {
+		if !isKeyFrameStart(packet.Payload) {
+			return nil
+		}
+		self.waitKeyFrame = false
+	}
+
+	if self.rebase {
+		if self.started {
+			// keep the wall clock distance to the last packet
+			step := uint32(time.Since(self.lastTime).Seconds() * float64(self.clockRate()))
+			if step < self.frameDuration() {
+				step = self.frameDuration()
+			}
+			self.seqOffset = self.lastSeq + 1 - packet.SequenceNumber
+			self.tsOffset = self.lastTS + step - packet.Timestamp
+		}
+		self.rebase = false
+	}
+
+	out := &rtp.Packet{Header: packet.Header, Payload: packet.Payload}
+	out.SSRC = self.ssrc
+	out.PayloadType = self.payloadType
+	out.SequenceNumber += self.seqOffset
+	out.Timestamp += self.tsOffset
+
+	self.lastSeq = out.SequenceNumber
+	self.lastTS = out.Timestamp
+	self.lastTime = time.Now()
+	self.started = true
+	if self.kind == webrtc.RTPCodecTypeAudio && self.encoding.isG711() {
+		// one byte per sample
+		self.lastSamples = uint32(len(packet.Payload))
+	} else if self.kind == webrtc.RTPCodecTypeAudio {
+		self.lastSamples = opusSamples(packet.Payload)
+	}
+	self.source = packet.SSRC
+
+	return out
+}
+
+// sent counts a packet written to the remote side.
+func (self *rtcTrack) sent(packet *rtp.Packet) {
+
+	self.Lock()
+	self.packetCount++
+	self.octetCount += uint32(len(packet.Payload))
+	self.Unlock()
+}
+
+// isKeyFrameStart reports whether the h264 payload starts an access unit
+// with SPS or IDR, the router puts SPS and PPS in front of every keyframe.
+func isKeyFrameStart(payload []byte) bool {
+
+	if len(payload) < 2 {
+		return false
+	}
+
+	switch payload[0] & 0x1f {
+	case naluTypeIDR, naluTypeSPS:
+		return true
+	case naluTypeSTAPA:
+		if len(payload) < 4 {
+			return false
+		}
+		naluType := payload[3] & 0x1f
+		return naluType == naluTypeIDR || naluType == naluTypeSPS
+	case naluTypeFUA:
+		// start bit and the type of the fragmented nalu
+		if payload[1]&0x80 == 0 {
+			return false
+		}
+		naluType := payload[1] & 0x1f
+		return naluType == naluTypeIDR || naluType == naluTypeSPS
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package rtcrtmp
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestTrackSwitchWaitsForKeyFrame(t *testing.T) {
+
+	track := &rtcTrack{ssrc: 5000, kind: webrtc.RTPCodecTypeVideo}
+
+	slice := []byte{0x41, 0x9a}
+	idr := []byte{0x65, 0x88}
+	packet := func(ssrc uint32, seq uint16, payload []byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true}, Payload: payload}
+	}
+
+	last := track.rewrite(packet(1, 10, slice))
+	if last == nil {
+		t.Fatal("first packet dropped")
+	}
+
+	track.switched()
+	if out := track.rewrite(packet(2, 500, slice)); out != nil {
+		t.Fatal("live frame before the keyframe of the new router sent")
+	}
+	out := track.rewrite(packet(2, 501, idr))
+	if out == nil {
+		t.Fatal("keyframe of the new router dropped")
+	}
+	if out.SSRC != 5000 || out.SequenceNumber != last.SequenceNumber+1 || out.Timestamp <= last.Timestamp {
+		t.Fatalf("keyframe ssrc %d seq %d ts %d after seq %d ts %d", out.SSRC, out.SequenceNumber, out.Timestamp, last.SequenceNumber, last.Timestamp)
+	}
+	if next := track.rewrite(packet(2, 502, slice)); next == nil || next.SequenceNumber != out.SequenceNumber+1 {
+		t.Fatal("frame after the keyframe not continued")
+	}
+}
@@ -0,0 +1,45 @@
+package trans
+
+import (
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// Backend is an audio codec library. The opus side of a Transformer goes
+// through its backend, the other side always through ffmpeg.
+//
+// Both backends are built by default, the noffmpeg and nogopus build tags
+// leave one out and its variable, FFmpeg or Gopus, is nil then. Without
+// ffmpeg only opus can be decoded and encoded.
+type Backend interface {
+	Name() string
+	// NewEncoder returns an encoder for the codec, Setup is left to the caller
+	NewEncoder(codec string) (av.AudioEncoder, error)
+	// NewDecoder returns a decoder for the codec, Setup is left to the caller
+	NewDecoder(codec string) (av.AudioDecoder, error)
+}
+
+// BackendByName returns the backend called ffmpeg or gopus.
+func BackendByName(name string) (Backend, error) {
+
+	for _, backend := range []Backend{FFmpeg, Gopus} {
+		if backend != nil && backend.Name() == name {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown audio backend %q", name)
+}
+
+// defaultOpusBackend codes opus when no backend is set, FFmpeg when it is
+// built, nil without any backend.
+func defaultOpusBackend() Backend {
+	if FFmpeg != nil {
+		return FFmpeg
+	}
+	return Gopus
+}
+
+func isOpus(codec string) bool {
+	return codec == "libopus" || codec == "opus"
+}
@@ -0,0 +1,137 @@
+package trans
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// toneFrame is the 20ms number n of a sine of freq Hz and peak amplitude,
+// 48k s16 on every channel of layout.
+func toneFrame(n int, freq float64, amplitude float64, layout av.ChannelLayout) av.AudioFrame {
+
+	const rate = 48000
+	samples := rate / 50
+	channels := layout.Count()
+	data := make([]byte, samples*channels*2)
+	for i := 0; i < samples; i++ {
+		v := int16(32767 * amplitude * math.Sin(2*math.Pi*freq*float64(n*samples+i)/rate))
+		for ch := 0; ch < channels; ch++ {
+			data[(i*channels+ch)*2] = byte(v)
+			data[(i*channels+ch)*2+1] = byte(v >> 8)
+		}
+	}
+	return av.AudioFrame{
+		SampleFormat:  av.S16,
+		ChannelLayout: layout,
+		SampleCount:   samples,
+		SampleRate:    rate,
+		Data:          [][]byte{data},
+	}
+}
+
+// toneLevel is the peak amplitude of the freq Hz component of samples.
+func toneLevel(samples []float64, freq float64, rate int) float64 {
+
+	var sum complex128
+	for i, v := range samples {
+		sum += complex(v, 0) * cmplx.Exp(complex(0, -2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return 2 * cmplx.Abs(sum) / float64(len(samples))
+}
+
+// channelSamples returns one channel of the decoded frames.
+func channelSamples(t *testing.T, frames []av.AudioFrame, ch int) []float64 {
+
+	samples := []float64{}
+	for _, frame := range frames {
+		interleaved, err := readSamples(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels := frame.ChannelLayout.Count()
+		for i := ch; i < len(interleaved); i += channels {
+			samples = append(samples, interleaved[i])
+		}
+	}
+	return samples
+}
+
+// testOpusRoundTrip encodes a second of a 440Hz tone with the backend and
+// decodes it again, the tone has to come back at its level.
+func testOpusRoundTrip(t *testing.T, backend Backend) {
+
+	enc, err := backend.NewEncoder("libopus")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer enc.Close()
+	enc.SetSampleRate(48000)
+	enc.SetChannelLayout(av.CH_STEREO)
+	enc.SetSampleFormat(av.S16)
+	enc.SetBitrate(64000)
+	if err = enc.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkts [][]byte
+	for n := 0; n < 50; n++ {
+		out, err := enc.Encode(toneFrame(n, 440, 0.25, av.CH_STEREO))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, out...)
+	}
+	if len(pkts) < 48 || len(pkts) > 50 {
+		t.Fatalf("%d packets for 50 frames", len(pkts))
+	}
+	for _, pkt := range pkts {
+		if dur, err := enc.PacketDuration(pkt); err != nil || dur != 20*time.Millisecond {
+			t.Fatalf("packet of %v, %v", dur, err)
+		}
+	}
+
+	dec, err := backend.NewDecoder("libopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	dec.SetSampleRate(48000)
+	dec.SetChannelLayout(av.CH_STEREO)
+	dec.SetSampleFormat(av.S16)
+	if err = dec.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	var frames []av.AudioFrame
+	for _, pkt := range pkts {
+		ok, frame, err := dec.Decode(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			frames = append(frames, frame)
+		}
+	}
+	if len(frames) != len(pkts) {
+		t.Fatalf("%d frames decoded from %d packets", len(frames), len(pkts))
+	}
+
+	for ch := 0; ch < 2; ch++ {
+		samples := channelSamples(t, frames, ch)
+		if len(samples) != len(pkts)*960 {
+			t.Fatalf("%d samples decoded from %d packets", len(samples), len(pkts))
+		}
+		// the encoder delay leaves the first frames quiet
+		samples = samples[10*960:]
+		if level := toneLevel(samples, 440, 48000); level < 0.25*0.7 || level > 0.25*1.3 {
+			t.Fatalf("channel %d: tone level %.3f, want 0.25", ch, level)
+		}
+		if level := toneLevel(samples, 1000, 48000); level > 0.01 {
+			t.Fatalf("channel %d: level %.3f at 1kHz", ch, level)
+		}
+	}
+}
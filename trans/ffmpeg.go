@@ -0,0 +1,379 @@
+//go:build !noffmpeg
+
+package trans
+
+/*
+#cgo LDFLAGS: -lavcodec -lavutil
+#cgo CFLAGS: -Wno-deprecated
+#include <libavcodec/avcodec.h>
+#include <libavutil/avutil.h>
+#include <libavutil/channel_layout.h>
+#include <libavutil/dict.h>
+#include <stdlib.h>
+#include <string.h>
+
+// first_option is an option avcodec_open2 left in the dictionary, one no
+// codec setting took
+static AVDictionaryEntry *first_option(AVDictionary *options) {
+	return av_dict_get(options, "", NULL, AV_DICT_IGNORE_SUFFIX);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/notedit/rtmp-lib/aac"
+	"github.com/notedit/rtmp-lib/audio"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// FFmpeg codes with ffmpeg, the rtmp-lib decoders and an encoder passing
+// its options to the codec. It is the default backend.
+var FFmpeg Backend = ffmpegBackend{}
+
+type ffmpegBackend struct{}
+
+func (ffmpegBackend) Name() string {
+	return "ffmpeg"
+}
+
+func (ffmpegBackend) NewEncoder(codec string) (av.AudioEncoder, error) {
+	enc, err := newFFmpegEncoder(codec)
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+func (ffmpegBackend) NewDecoder(codec string) (av.AudioDecoder, error) {
+	dec, err := audio.NewAudioDecoderByName(codec)
+	if err != nil {
+		return nil, err
+	}
+	return dec, nil
+}
+
+// newResampler returns the ffmpeg resampler to the format.
+func newResampler(out audioFormat) frameResampler {
+	return &audio.Resampler{
+		OutSampleFormat:  out.sampleFormat,
+		OutChannelLayout: out.channelLayout,
+		OutSampleRate:    out.sampleRate,
+	}
+}
+
+// ffmpegEncoder is the rtmp-lib audio encoder passing its options to
+// avcodec_open2. The rtmp-lib one opens the codec without them, the libopus
+// settings of an OpusConfig never reached the codec.
+type ffmpegEncoder struct {
+	name  string
+	codec *C.AVCodec
+	ctx   *C.AVCodecContext
+	frame *C.AVFrame
+
+	sampleRate    int
+	bitrate       int
+	channelLayout av.ChannelLayout
+	sampleFormat  av.SampleFormat
+	options       map[string]string
+
+	// samples of one codec frame, 0 when the codec takes any count
+	frameSampleCount int
+	framebuf         av.AudioFrame
+	codecData        av.AudioCodecData
+	resampler        *audio.Resampler
+}
+
+func newFFmpegEncoder(name string) (*ffmpegEncoder, error) {
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	codec := C.avcodec_find_encoder_by_name(cname)
+	if codec == nil || C.avcodec_get_type(codec.id) != C.AVMEDIA_TYPE_AUDIO {
+		return nil, fmt.Errorf("ffmpeg: cannot find audio encoder name=%s", name)
+	}
+	ctx := C.avcodec_alloc_context3(codec)
+	if ctx == nil {
+		return nil, fmt.Errorf("ffmpeg: cannot allocate encoder %s", name)
+	}
+	return &ffmpegEncoder{name: name, codec: codec, ctx: ctx, options: map[string]string{}}, nil
+}
+
+func (e *ffmpegEncoder) SetSampleRate(rate int) error {
+	e.sampleRate = rate
+	return nil
+}
+
+func (e *ffmpegEncoder) SetChannelLayout(layout av.ChannelLayout) error {
+	e.channelLayout = layout
+	return nil
+}
+
+func (e *ffmpegEncoder) SetSampleFormat(format av.SampleFormat) error {
+	e.sampleFormat = format
+	return nil
+}
+
+func (e *ffmpegEncoder) SetBitrate(bitrate int) error {
+	e.bitrate = bitrate
+	return nil
+}
+
+// SetOption sets a codec option, Setup fails on options the codec does not
+// know.
+func (e *ffmpegEncoder) SetOption(key string, val interface{}) error {
+	e.options[key] = fmt.Sprint(val)
+	return nil
+}
+
+func (e *ffmpegEncoder) GetOption(key string, val interface{}) error {
+
+	sval, ok := e.options[key]
+	if !ok {
+		return fmt.Errorf("ffmpeg: GetOption failed: `%s` not exists", key)
+	}
+	switch p := val.(type) {
+	case *string:
+		*p = sval
+	case *int:
+		fmt.Sscanf(sval, "%d", p)
+	default:
+		return fmt.Errorf("ffmpeg: GetOption failed: val must be *string or *int receiver")
+	}
+	return nil
+}
+
+func (e *ffmpegEncoder) Setup() error {
+
+	if e.sampleFormat == 0 {
+		e.sampleFormat = sampleFormatFF2AV(int32(*e.codec.sample_fmts))
+	}
+	if e.sampleRate == 0 {
+		e.sampleRate = 44100
+	}
+	if e.channelLayout == 0 {
+		e.channelLayout = av.CH_STEREO
+	}
+
+	e.ctx.sample_fmt = sampleFormatAV2FF(e.sampleFormat)
+	e.ctx.sample_rate = C.int(e.sampleRate)
+	e.ctx.bit_rate = C.int64_t(e.bitrate)
+	e.ctx.channel_layout = channelLayoutAV2FF(e.channelLayout)
+	e.ctx.channels = C.int(e.channelLayout.Count())
+
+	var options *C.AVDictionary
+	defer C.av_dict_free(&options)
+	for key, val := range e.options {
+		ckey, cval := C.CString(key), C.CString(val)
+		C.av_dict_set(&options, ckey, cval, 0)
+		C.free(unsafe.Pointer(ckey))
+		C.free(unsafe.Pointer(cval))
+	}
+
+	if C.avcodec_open2(e.ctx, e.codec, &options) != 0 {
+		return fmt.Errorf("ffmpeg: encoder %s: avcodec_open2 failed", e.name)
+	}
+	if entry := C.first_option(options); entry != nil {
+		return fmt.Errorf("ffmpeg: encoder %s has no option %s", e.name, C.GoString(entry.key))
+	}
+
+	e.sampleFormat = sampleFormatFF2AV(int32(e.ctx.sample_fmt))
+	e.frameSampleCount = int(e.ctx.frame_size)
+	e.frame = C.av_frame_alloc()
+
+	extradata := C.GoBytes(unsafe.Pointer(e.ctx.extradata), e.ctx.extradata_size)
+	if e.ctx.codec_id == C.AV_CODEC_ID_AAC {
+		codecData, err := aac.NewCodecDataFromMPEG4AudioConfigBytes(extradata)
+		if err != nil {
+			return err
+		}
+		e.codecData = codecData
+	} else {
+		e.codecData = ffmpegCodecData{
+			codecType:     av.MakeAudioCodecType(uint32(e.ctx.codec_id)),
+			sampleFormat:  e.sampleFormat,
+			sampleRate:    e.sampleRate,
+			channelLayout: e.channelLayout,
+		}
+	}
+	return nil
+}
+
+func (e *ffmpegEncoder) CodecData() (av.AudioCodecData, error) {
+	if e.codecData == nil {
+		return nil, fmt.Errorf("ffmpeg: encoder %s is not set up", e.name)
+	}
+	return e.codecData, nil
+}
+
+func (e *ffmpegEncoder) Encode(frame av.AudioFrame) (pkts [][]byte, err error) {
+
+	if frame.SampleFormat != e.sampleFormat || frame.ChannelLayout != e.channelLayout || frame.SampleRate != e.sampleRate {
+		if e.resampler == nil {
+			e.resampler = &audio.Resampler{
+				OutSampleFormat:  e.sampleFormat,
+				OutChannelLayout: e.channelLayout,
+				OutSampleRate:    e.sampleRate,
+			}
+		}
+		if frame, err = e.resampler.Resample(frame); err != nil {
+			return
+		}
+	}
+	if frame.SampleCount == 0 {
+		return
+	}
+
+	if e.frameSampleCount == 0 {
+		return e.encodeOne(frame, pkts)
+	}
+
+	if e.framebuf.SampleCount == 0 {
+		e.framebuf = frame
+	} else {
+		e.framebuf = e.framebuf.Concat(frame)
+	}
+	for e.framebuf.SampleCount >= e.frameSampleCount {
+		if pkts, err = e.encodeOne(e.framebuf.Slice(0, e.frameSampleCount), pkts); err != nil {
+			return
+		}
+		e.framebuf = e.framebuf.Slice(e.frameSampleCount, e.framebuf.SampleCount)
+	}
+	return
+}
+
+// encodeOne copies the frame into the codec frame and appends the packet
+// the codec returns for it.
+func (e *ffmpegEncoder) encodeOne(frame av.AudioFrame, pkts [][]byte) ([][]byte, error) {
+
+	C.av_frame_unref(e.frame)
+	e.frame.format = C.int(sampleFormatAV2FF(frame.SampleFormat))
+	e.frame.channel_layout = channelLayoutAV2FF(frame.ChannelLayout)
+	e.frame.channels = C.int(frame.ChannelLayout.Count())
+	e.frame.sample_rate = C.int(frame.SampleRate)
+	e.frame.nb_samples = C.int(frame.SampleCount)
+	if C.av_frame_get_buffer(e.frame, 0) < 0 {
+		return pkts, fmt.Errorf("ffmpeg: encoder %s: av_frame_get_buffer failed", e.name)
+	}
+	for i, data := range frame.Data {
+		if len(data) > 0 {
+			C.memcpy(unsafe.Pointer(e.frame.data[i]), unsafe.Pointer(&data[0]), C.size_t(len(data)))
+		}
+	}
+
+	pkt := C.AVPacket{}
+	got := C.int(0)
+	if cerr := C.avcodec_encode_audio2(e.ctx, &pkt, e.frame, &got); cerr < 0 {
+		return pkts, fmt.Errorf("ffmpeg: avcodec_encode_audio2 failed: %d", cerr)
+	}
+	if got != 0 {
+		pkts = append(pkts, C.GoBytes(unsafe.Pointer(pkt.data), pkt.size))
+		C.av_packet_unref(&pkt)
+	}
+	return pkts, nil
+}
+
+func (e *ffmpegEncoder) PacketDuration(data []byte) (time.Duration, error) {
+	duration := C.av_get_audio_frame_duration(e.ctx, C.int(len(data)))
+	return time.Duration(int(duration)) * time.Second / time.Duration(e.sampleRate), nil
+}
+
+func (e *ffmpegEncoder) Close() {
+	if e.frame != nil {
+		C.av_frame_free(&e.frame)
+	}
+	if e.ctx != nil {
+		C.avcodec_free_context(&e.ctx)
+	}
+	if e.resampler != nil {
+		e.resampler.Close()
+		e.resampler = nil
+	}
+}
+
+// ffmpegCodecData describes the codecs without a container codec data of
+// their own.
+type ffmpegCodecData struct {
+	codecType     av.CodecType
+	sampleFormat  av.SampleFormat
+	sampleRate    int
+	channelLayout av.ChannelLayout
+}
+
+func (c ffmpegCodecData) Type() av.CodecType {
+	return c.codecType
+}
+
+func (c ffmpegCodecData) SampleFormat() av.SampleFormat {
+	return c.sampleFormat
+}
+
+func (c ffmpegCodecData) SampleRate() int {
+	return c.sampleRate
+}
+
+func (c ffmpegCodecData) ChannelLayout() av.ChannelLayout {
+	return c.channelLayout
+}
+
+var sampleFormats = []struct {
+	av av.SampleFormat
+	ff int32
+}{
+	{av.U8, C.AV_SAMPLE_FMT_U8},
+	{av.S16, C.AV_SAMPLE_FMT_S16},
+	{av.S32, C.AV_SAMPLE_FMT_S32},
+	{av.FLT, C.AV_SAMPLE_FMT_FLT},
+	{av.DBL, C.AV_SAMPLE_FMT_DBL},
+	{av.U8P, C.AV_SAMPLE_FMT_U8P},
+	{av.S16P, C.AV_SAMPLE_FMT_S16P},
+	{av.S32P, C.AV_SAMPLE_FMT_S32P},
+	{av.FLTP, C.AV_SAMPLE_FMT_FLTP},
+	{av.DBLP, C.AV_SAMPLE_FMT_DBLP},
+}
+
+func sampleFormatAV2FF(format av.SampleFormat) int32 {
+	for _, f := range sampleFormats {
+		if f.av == format {
+			return f.ff
+		}
+	}
+	return C.AV_SAMPLE_FMT_NONE
+}
+
+func sampleFormatFF2AV(format int32) av.SampleFormat {
+	for _, f := range sampleFormats {
+		if f.ff == format {
+			return f.av
+		}
+	}
+	return 0
+}
+
+var channelMasks = []struct {
+	av av.ChannelLayout
+	ff C.uint64_t
+}{
+	{av.CH_FRONT_CENTER, C.AV_CH_FRONT_CENTER},
+	{av.CH_FRONT_LEFT, C.AV_CH_FRONT_LEFT},
+	{av.CH_FRONT_RIGHT, C.AV_CH_FRONT_RIGHT},
+	{av.CH_BACK_CENTER, C.AV_CH_BACK_CENTER},
+	{av.CH_BACK_LEFT, C.AV_CH_BACK_LEFT},
+	{av.CH_BACK_RIGHT, C.AV_CH_BACK_RIGHT},
+	{av.CH_SIDE_LEFT, C.AV_CH_SIDE_LEFT},
+	{av.CH_SIDE_RIGHT, C.AV_CH_SIDE_RIGHT},
+	{av.CH_LOW_FREQ, C.AV_CH_LOW_FREQUENCY},
+}
+
+func channelLayoutAV2FF(layout av.ChannelLayout) (fflayout C.uint64_t) {
+	for _, ch := range channelMasks {
+		if layout&ch.av != 0 {
+			fflayout |= ch.ff
+		}
+	}
+	return
+}
@@ -0,0 +1,167 @@
+//go:build !noffmpeg
+
+package trans
+
+import (
+	"math"
+	"testing"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// rangeDecoder reads the range coded symbols of an opus frame, see RFC 6716
+// section 4.1.
+type rangeDecoder struct {
+	buf []byte
+	pos int
+	rem uint32
+	rng uint32
+	val uint32
+}
+
+func newRangeDecoder(buf []byte) *rangeDecoder {
+	d := &rangeDecoder{buf: buf, rng: 128}
+	d.rem = d.next()
+	d.val = 127 - d.rem>>1
+	d.normalize()
+	return d
+}
+
+func (d *rangeDecoder) next() uint32 {
+	if d.pos >= len(d.buf) {
+		return 0
+	}
+	d.pos++
+	return uint32(d.buf[d.pos-1])
+}
+
+func (d *rangeDecoder) normalize() {
+	for d.rng <= 1<<23 {
+		d.rng <<= 8
+		sym := d.rem
+		d.rem = d.next()
+		sym = (sym<<8 | d.rem) >> 1
+		d.val = (d.val<<8 + (255 &^ sym)) & 0x7fffffff
+	}
+}
+
+// bit decodes a symbol of probability one half.
+func (d *rangeDecoder) bit() bool {
+	s := d.rng >> 1
+	one := d.val < s
+	if one {
+		d.rng = s
+	} else {
+		d.val -= s
+		d.rng -= s
+	}
+	d.normalize()
+	return one
+}
+
+// silkLBRR reads the LBRR flag of a mono silk or hybrid packet of one 20ms
+// frame, it follows the VAD flag at the start of the silk layer. ok is false
+// for the other packets.
+func silkLBRR(packet []byte) (lbrr bool, ok bool) {
+
+	if len(packet) < 2 || packet[0]&0x03 != 0 {
+		return false, false
+	}
+	config := packet[0] >> 3
+	if config >= 16 || (config < 12 && config%4 != 1) || (config >= 12 && config%2 != 1) {
+		return false, false
+	}
+	d := newRangeDecoder(packet[1:])
+	d.bit()
+	return d.bit(), true
+}
+
+// voiceFrame is 20ms of a modulated 220Hz tone, 48k mono s16.
+func voiceFrame(n int) av.AudioFrame {
+
+	const rate = 48000
+	samples := rate / 50
+	data := make([]byte, samples*2)
+	for i := 0; i < samples; i++ {
+		t := float64(n*samples+i) / rate
+		v := int16(8000 * math.Sin(2*math.Pi*220*t) * (0.6 + 0.4*math.Sin(2*math.Pi*3*t)))
+		data[i*2] = byte(v)
+		data[i*2+1] = byte(v >> 8)
+	}
+	return av.AudioFrame{
+		SampleFormat:  av.S16,
+		ChannelLayout: av.CH_MONO,
+		SampleCount:   samples,
+		SampleRate:    rate,
+		Data:          [][]byte{data},
+	}
+}
+
+func TestFFmpegOpusFEC(t *testing.T) {
+
+	for _, fec := range []bool{false, true} {
+
+		config := OpusConfig{Bitrate: 24000, FEC: fec, Application: OpusVoIP, Mono: true}
+		enc, err := FFmpeg.NewEncoder("libopus")
+		if err != nil {
+			t.Skip(err)
+		}
+		enc.SetSampleRate(48000)
+		enc.SetChannelLayout(av.CH_MONO)
+		enc.SetSampleFormat(av.S16)
+		enc.SetBitrate(config.Bitrate)
+		for key, val := range config.Options() {
+			enc.SetOption(key, val)
+		}
+		if err = enc.Setup(); err != nil {
+			t.Fatal(err)
+		}
+
+		silk, lbrr := 0, 0
+		for n := 0; n < 50; n++ {
+			pkts, err := enc.Encode(voiceFrame(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pkt := range pkts {
+				if flag, ok := silkLBRR(pkt); ok {
+					silk++
+					if flag {
+						lbrr++
+					}
+				}
+			}
+		}
+		enc.Close()
+
+		if silk == 0 {
+			t.Fatalf("fec %v: no silk packets at 24kbps voip", fec)
+		}
+		if fec && lbrr == 0 {
+			t.Fatalf("fec on: none of %d silk packets carries LBRR", silk)
+		}
+		if !fec && lbrr != 0 {
+			t.Fatalf("fec off: %d of %d silk packets carry LBRR", lbrr, silk)
+		}
+	}
+}
+
+func TestFFmpegUnknownOption(t *testing.T) {
+
+	enc, err := FFmpeg.NewEncoder("libopus")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer enc.Close()
+	enc.SetSampleRate(48000)
+	enc.SetChannelLayout(av.CH_STEREO)
+	enc.SetSampleFormat(av.S16)
+	enc.SetOption("no_such_option", "1")
+	if err = enc.Setup(); err == nil {
+		t.Fatal("unknown option taken")
+	}
+}
+
+func TestFFmpegRoundTrip(t *testing.T) {
+	testOpusRoundTrip(t, FFmpeg)
+}
@@ -0,0 +1,29 @@
+package trans
+
+import (
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// ffmpeg encoders of the G.711 laws
+const (
+	PCMU = "pcm_mulaw"
+	PCMA = "pcm_alaw"
+)
+
+// G711SampleRate is the only rate G.711 runs at, one byte per sample
+const G711SampleRate = 8000
+
+// SetG711Out makes the transformer encode 8kHz mono G.711, codec is PCMU or
+// PCMA. Call it before Setup.
+func (t *Transformer) SetG711Out(codec string) error {
+	if codec != PCMU && codec != PCMA {
+		return fmt.Errorf("unknown g711 encoder %s", codec)
+	}
+	t.outCodec = codec
+	t.outSampleRate = G711SampleRate
+	t.outChannelLayout = av.CH_MONO
+	t.outSampleFormat = av.S16
+	return nil
+}
@@ -0,0 +1,272 @@
+//go:build !nogopus
+
+package trans
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+	"layeh.com/gopus"
+)
+
+// maxOpusPacket is the largest opus packet, 3 frames of 1275 bytes and
+// their framing
+const maxOpusPacket = 4000
+
+// maxOpusDuration is the longest opus packet, the decoder needs room for it
+const maxOpusDuration = 120 * time.Millisecond
+
+// Gopus codes opus with layeh.com/gopus, it knows no other codec.
+var Gopus Backend = gopusBackend{}
+
+type gopusBackend struct{}
+
+func (gopusBackend) Name() string {
+	return "gopus"
+}
+
+func (gopusBackend) NewEncoder(codec string) (av.AudioEncoder, error) {
+	if !isOpus(codec) {
+		return nil, fmt.Errorf("gopus: cannot encode %s", codec)
+	}
+	return &gopusEncoder{}, nil
+}
+
+func (gopusBackend) NewDecoder(codec string) (av.AudioDecoder, error) {
+	if !isOpus(codec) {
+		return nil, fmt.Errorf("gopus: cannot decode %s", codec)
+	}
+	return &gopusDecoder{}, nil
+}
+
+// gopusEncoder encodes interleaved s16 audio, other formats go through the
+// cgo-free resampler first like they go through the ffmpeg one in the ffmpeg
+// encoder.
+type gopusEncoder struct {
+	sampleRate    int
+	channelLayout av.ChannelLayout
+	sampleFormat  av.SampleFormat
+	bitrate       int
+	application   gopus.Application
+	frameDuration time.Duration
+
+	enc       *gopus.Encoder
+	resampler *goResampler
+	// samples waiting for a full frame
+	pcm []int16
+}
+
+func (e *gopusEncoder) SetSampleRate(rate int) error {
+	e.sampleRate = rate
+	return nil
+}
+
+func (e *gopusEncoder) SetChannelLayout(layout av.ChannelLayout) error {
+	e.channelLayout = layout
+	return nil
+}
+
+func (e *gopusEncoder) SetSampleFormat(format av.SampleFormat) error {
+	e.sampleFormat = format
+	return nil
+}
+
+func (e *gopusEncoder) SetBitrate(bitrate int) error {
+	e.bitrate = bitrate
+	return nil
+}
+
+// SetOption takes the application and frame_duration options of the ffmpeg
+// libopus encoder, gopus has no setting for the others.
+func (e *gopusEncoder) SetOption(key string, val interface{}) error {
+
+	s := fmt.Sprint(val)
+	switch key {
+	case "application":
+		switch OpusApplication(s) {
+		case OpusVoIP:
+			e.application = gopus.Voip
+		case OpusAudio:
+			e.application = gopus.Audio
+		case OpusLowDelay:
+			e.application = gopus.RestrictedLowDelay
+		default:
+			return fmt.Errorf("gopus: unknown application %q", s)
+		}
+	case "frame_duration":
+		ms, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("gopus: invalid frame duration %q", s)
+		}
+		e.frameDuration = time.Duration(ms * float64(time.Millisecond))
+	default:
+		return fmt.Errorf("gopus: option %s not supported", key)
+	}
+	return nil
+}
+
+func (e *gopusEncoder) GetOption(key string, val interface{}) error {
+	return fmt.Errorf("gopus: option %s not supported", key)
+}
+
+func (e *gopusEncoder) Setup() error {
+
+	if e.sampleRate == 0 {
+		e.sampleRate = 48000
+	}
+	if e.channelLayout == 0 {
+		e.channelLayout = av.CH_STEREO
+	}
+	if e.sampleFormat == 0 {
+		e.sampleFormat = av.S16
+	}
+	if e.sampleFormat != av.S16 {
+		return fmt.Errorf("gopus: encoder takes s16 samples, not %v", e.sampleFormat)
+	}
+	if e.application == 0 {
+		e.application = gopus.Audio
+	}
+	if e.frameDuration == 0 {
+		e.frameDuration = 20 * time.Millisecond
+	}
+
+	enc, err := gopus.NewEncoder(e.sampleRate, e.channelLayout.Count(), e.application)
+	if err != nil {
+		return err
+	}
+	if e.bitrate != 0 {
+		enc.SetBitrate(e.bitrate)
+	}
+	e.enc = enc
+	return nil
+}
+
+func (e *gopusEncoder) CodecData() (av.AudioCodecData, error) {
+	return nil, fmt.Errorf("gopus: no container codec data for opus")
+}
+
+func (e *gopusEncoder) Encode(frame av.AudioFrame) (pkts [][]byte, err error) {
+
+	if frame.SampleFormat != e.sampleFormat || frame.ChannelLayout != e.channelLayout || frame.SampleRate != e.sampleRate {
+		if e.resampler == nil {
+			e.resampler = newGoResampler(audioFormat{e.sampleRate, e.channelLayout, e.sampleFormat})
+		}
+		if frame, err = e.resampler.Resample(frame); err != nil {
+			return
+		}
+	}
+	if len(frame.Data) == 0 {
+		return
+	}
+
+	data := frame.Data[0]
+	for i := 0; i+1 < len(data); i += 2 {
+		e.pcm = append(e.pcm, int16(binary.LittleEndian.Uint16(data[i:])))
+	}
+
+	frameSize := int(e.frameDuration * time.Duration(e.sampleRate) / time.Second)
+	samples := frameSize * e.channelLayout.Count()
+	consumed := 0
+	for len(e.pcm)-consumed >= samples {
+		var pkt []byte
+		if pkt, err = e.enc.Encode(e.pcm[consumed:consumed+samples], frameSize, maxOpusPacket); err != nil {
+			return
+		}
+		pkts = append(pkts, append([]byte(nil), pkt...))
+		consumed += samples
+	}
+	e.pcm = append(e.pcm[:0], e.pcm[consumed:]...)
+	return
+}
+
+func (e *gopusEncoder) PacketDuration(data []byte) (time.Duration, error) {
+	return OpusPacketDuration(data)
+}
+
+func (e *gopusEncoder) Close() {
+	if e.resampler != nil {
+		e.resampler.Close()
+		e.resampler = nil
+	}
+}
+
+// gopusDecoder decodes to interleaved s16 audio.
+type gopusDecoder struct {
+	sampleRate    int
+	channelLayout av.ChannelLayout
+	sampleFormat  av.SampleFormat
+
+	dec *gopus.Decoder
+}
+
+func (d *gopusDecoder) SetSampleRate(rate int) error {
+	d.sampleRate = rate
+	return nil
+}
+
+func (d *gopusDecoder) SetChannelLayout(layout av.ChannelLayout) error {
+	d.channelLayout = layout
+	return nil
+}
+
+func (d *gopusDecoder) SetSampleFormat(format av.SampleFormat) error {
+	d.sampleFormat = format
+	return nil
+}
+
+func (d *gopusDecoder) Setup() error {
+
+	if d.sampleRate == 0 {
+		d.sampleRate = 48000
+	}
+	if d.channelLayout == 0 {
+		d.channelLayout = av.CH_STEREO
+	}
+	if d.sampleFormat != 0 && d.sampleFormat != av.S16 {
+		return fmt.Errorf("gopus: decoder gives s16 samples, not %v", d.sampleFormat)
+	}
+	d.sampleFormat = av.S16
+
+	dec, err := gopus.NewDecoder(d.sampleRate, d.channelLayout.Count())
+	if err != nil {
+		return err
+	}
+	d.dec = dec
+	return nil
+}
+
+func (d *gopusDecoder) Decode(pkt []byte) (bool, av.AudioFrame, error) {
+
+	frameSize := int(maxOpusDuration * time.Duration(d.sampleRate) / time.Second)
+	pcm, err := d.dec.Decode(pkt, frameSize, false)
+	if err != nil {
+		return false, av.AudioFrame{}, err
+	}
+	if len(pcm) == 0 {
+		return false, av.AudioFrame{}, nil
+	}
+
+	data := make([]byte, len(pcm)*2)
+	for i, sample := range pcm {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+
+	frame := av.AudioFrame{
+		SampleFormat:  d.sampleFormat,
+		ChannelLayout: d.channelLayout,
+		SampleCount:   len(pcm) / d.channelLayout.Count(),
+		SampleRate:    d.sampleRate,
+		Data:          [][]byte{data},
+	}
+	return true, frame, nil
+}
+
+func (d *gopusDecoder) PacketDuration(data []byte) (time.Duration, error) {
+	return OpusPacketDuration(data)
+}
+
+func (d *gopusDecoder) Close() {
+}
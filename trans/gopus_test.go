@@ -0,0 +1,56 @@
+//go:build !nogopus
+
+package trans
+
+import (
+	"math"
+	"testing"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+func TestGopusRoundTrip(t *testing.T) {
+	testOpusRoundTrip(t, Gopus)
+}
+
+// TestGopusResample feeds the encoder 44.1k planar float audio, it goes
+// through the cgo-free resampler.
+func TestGopusResample(t *testing.T) {
+
+	enc, err := Gopus.NewEncoder("libopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	enc.SetSampleRate(48000)
+	enc.SetChannelLayout(av.CH_STEREO)
+	enc.SetSampleFormat(av.S16)
+	if err = enc.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	const rate = 44100
+	pkts := 0
+	for n := 0; n < 43; n++ {
+		left := make([]float32, 1024)
+		for i := range left {
+			left[i] = float32(0.25 * math.Sin(2*math.Pi*440*float64(n*1024+i)/rate))
+		}
+		frame := av.AudioFrame{
+			SampleFormat:  av.FLTP,
+			ChannelLayout: av.CH_STEREO,
+			SampleCount:   1024,
+			SampleRate:    rate,
+			Data:          [][]byte{floatBytes(left), floatBytes(left)},
+		}
+		out, err := enc.Encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts += len(out)
+	}
+	// 43 * 1024 samples at 44.1k are 998ms, 49 frames of 20ms at 48k
+	if pkts != 49 {
+		t.Fatalf("%d packets for 998ms", pkts)
+	}
+}
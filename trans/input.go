@@ -0,0 +1,42 @@
+package trans
+
+import (
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// MP3 is the codec type of mp3 audio, rtmp-lib has none. It is outside the
+// range of the rtmp-lib codec types.
+var MP3 = av.MakeAudioCodecType(233333 + 0x100)
+
+// decoderNames are the ffmpeg decoders of the audio codecs flv carries.
+var decoderNames = map[av.CodecType]string{
+	av.AAC:        "aac",
+	MP3:           "mp3",
+	av.SPEEX:      "libspeex",
+	av.NELLYMOSER: "nellymoser",
+	av.PCM_MULAW:  "pcm_mulaw",
+	av.PCM_ALAW:   "pcm_alaw",
+}
+
+// DecoderName is the ffmpeg decoder of an audio codec type.
+func DecoderName(codec av.CodecType) (string, bool) {
+	name, ok := decoderNames[codec]
+	return name, ok
+}
+
+// SetInCodecData sets the decoder and the input format from the codec data
+// of the source stream, its packet durations tell the decoded sample rate
+func (t *Transformer) SetInCodecData(codec av.AudioCodecData) error {
+	name, ok := DecoderName(codec.Type())
+	if !ok {
+		return fmt.Errorf("no decoder for audio codec %s", codec.Type())
+	}
+	t.inCodec = name
+	t.inCodecData = codec
+	t.inSampleRate = codec.SampleRate()
+	t.inChannelLayout = codec.ChannelLayout()
+	t.inSampleFormat = codec.SampleFormat()
+	return nil
+}
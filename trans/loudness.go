@@ -0,0 +1,492 @@
+package trans
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// LoudnessConfig sets the processing between decoding and encoding, the zero
+// value leaves the audio untouched. Normalization comes first, then the
+// manual gain, then the limiter.
+type LoudnessConfig struct {
+	// TargetLUFS normalizes the loudness measured per EBU R128 to this
+	// level, like -23 for broadcast or -16 for the web. Zero disables it.
+	TargetLUFS float64
+	// MaxGain limits the boost of the normalization in dB, default 12
+	MaxGain float64
+	// Gain is a manual gain in dB
+	Gain float64
+	// Limiter keeps the sample peaks under Ceiling
+	Limiter bool
+	// Ceiling of the limiter in dBFS, default -1
+	Ceiling float64
+}
+
+// Validate checks the ranges of the config.
+func (c LoudnessConfig) Validate() error {
+
+	if c.TargetLUFS != 0 && (c.TargetLUFS < -70 || c.TargetLUFS > -5) {
+		return fmt.Errorf("loudness target %v out of range -70 to -5 LUFS", c.TargetLUFS)
+	}
+	if c.MaxGain < 0 || c.MaxGain > 40 {
+		return fmt.Errorf("loudness max gain %v out of range 0-40 dB", c.MaxGain)
+	}
+	if c.Gain < -60 || c.Gain > 40 {
+		return fmt.Errorf("gain %v out of range -60 to 40 dB", c.Gain)
+	}
+	if c.Ceiling < -20 || c.Ceiling > 0 {
+		return fmt.Errorf("limiter ceiling %v out of range -20 to 0 dBFS", c.Ceiling)
+	}
+	return nil
+}
+
+func (c LoudnessConfig) enabled() bool {
+	return c.TargetLUFS != 0 || c.Gain != 0 || c.Limiter
+}
+
+// Loudness is the measurement of a transcoding, the loudness values are in
+// LUFS of the audio before the processing and -Inf while silent.
+type Loudness struct {
+	// Momentary is the loudness of the last 400ms
+	Momentary float64
+	// ShortTerm is the loudness of the last 3s
+	ShortTerm float64
+	// Integrated is the gated loudness of the whole stream
+	Integrated float64
+	// Gain is the normalization and manual gain applied in dB
+	Gain float64
+	// Reduction is the gain reduction of the limiter in the last frame in dB
+	Reduction float64
+}
+
+const (
+	// loudnessStep is the hop of the 400ms gating blocks, they overlap by 75%
+	loudnessStep = 100 * time.Millisecond
+	// normalizeWindow is the gated loudness the normalization follows
+	normalizeWindow = 10 * time.Second
+	// gainSlew is how fast the normalization gain moves in dB per second
+	gainSlew = 3.0
+	// limiterRelease is the time constant the limiter recovers with
+	limiterRelease = 50 * time.Millisecond
+
+	absoluteGate = -70.0
+	relativeGate = -10.0
+
+	// the integrated loudness histogram has bins of 0.1 LU up to +10 LUFS
+	histogramBins = 800
+	histogramStep = 0.1
+)
+
+// channelOrder is the order of the interleaved or planar channels, the one
+// of ffmpeg
+var channelOrder = []av.ChannelLayout{
+	av.CH_FRONT_LEFT, av.CH_FRONT_RIGHT, av.CH_FRONT_CENTER, av.CH_LOW_FREQ,
+	av.CH_BACK_LEFT, av.CH_BACK_RIGHT, av.CH_BACK_CENTER, av.CH_SIDE_LEFT, av.CH_SIDE_RIGHT,
+}
+
+// channelWeights are the BS.1770 weights of the channels of a layout, the
+// surround channels count more and the LFE not at all.
+func channelWeights(layout av.ChannelLayout) []float64 {
+
+	weights := []float64{}
+	for _, channel := range channelOrder {
+		if layout&channel == 0 {
+			continue
+		}
+		switch channel {
+		case av.CH_LOW_FREQ:
+			weights = append(weights, 0)
+		case av.CH_BACK_LEFT, av.CH_BACK_RIGHT, av.CH_SIDE_LEFT, av.CH_SIDE_RIGHT:
+			weights = append(weights, 1.41)
+		default:
+			weights = append(weights, 1)
+		}
+	}
+	for len(weights) < layout.Count() {
+		weights = append(weights, 1)
+	}
+	return weights
+}
+
+// biquad is a second order filter in direct form 1.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the two stages of the BS.1770 K-weighting filter for a
+// sample rate, a high shelf and a high pass.
+func kWeighting(sampleRate int) (shelf biquad, highpass biquad) {
+
+	fs := float64(sampleRate)
+
+	f0 := 1681.974450955533
+	g := 3.999843853973347
+	q := 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, g/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf = biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+	highpass = biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return
+}
+
+func energyLUFS(energy float64) float64 {
+	if energy <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(energy)
+}
+
+func dbGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// loudnessProcessor measures and processes frames of one transcoding.
+type loudnessProcessor struct {
+	config LoudnessConfig
+
+	sampleRate int
+	layout     av.ChannelLayout
+	weights    []float64
+	shelves    []biquad
+	highpasses []biquad
+
+	// weighted mean squares of the last 3s of steps, the one in progress
+	// sums up stepEnergy over stepSamples
+	steps       []float64
+	stepEnergy  float64
+	stepSamples int
+	// energies of the gating blocks of the normalization window
+	blocks []float64
+	// counts and energy sums of the gating blocks of the whole stream
+	histogram       [histogramBins]int
+	histogramEnergy [histogramBins]float64
+
+	// normalization gain in dB and the limiter gain
+	gain     float64
+	limiter  float64
+	measured Loudness
+
+	sync.RWMutex
+}
+
+func newLoudnessProcessor(config LoudnessConfig) *loudnessProcessor {
+
+	if config.MaxGain == 0 {
+		config.MaxGain = 12
+	}
+	if config.Ceiling == 0 {
+		config.Ceiling = -1
+	}
+	return &loudnessProcessor{
+		config:  config,
+		limiter: 1,
+		measured: Loudness{
+			Momentary:  math.Inf(-1),
+			ShortTerm:  math.Inf(-1),
+			Integrated: math.Inf(-1),
+			Gain:       config.Gain,
+		},
+	}
+}
+
+// reset sets the filters up for a new format, the measurements carry on.
+func (p *loudnessProcessor) reset(sampleRate int, layout av.ChannelLayout) {
+
+	p.sampleRate = sampleRate
+	p.layout = layout
+	p.weights = channelWeights(layout)
+	p.shelves = make([]biquad, len(p.weights))
+	p.highpasses = make([]biquad, len(p.weights))
+	for i := range p.weights {
+		p.shelves[i], p.highpasses[i] = kWeighting(sampleRate)
+	}
+	p.stepEnergy = 0
+	p.stepSamples = 0
+}
+
+// process measures a frame and applies the gains to it in place.
+func (p *loudnessProcessor) process(frame av.AudioFrame) error {
+
+	if frame.SampleCount == 0 {
+		return nil
+	}
+	if frame.SampleRate != p.sampleRate || frame.ChannelLayout != p.layout {
+		p.reset(frame.SampleRate, frame.ChannelLayout)
+	}
+
+	samples, err := readSamples(frame)
+	if err != nil {
+		return err
+	}
+
+	p.measure(samples)
+
+	// the normalization gain ramps over the frame to its new value
+	from := p.gain + p.config.Gain
+	if p.config.TargetLUFS != 0 {
+		p.gain = p.normalizationGain(frame.Duration())
+	}
+	to := p.gain + p.config.Gain
+
+	channels := len(p.weights)
+	ceiling := dbGain(p.config.Ceiling)
+	release := 1 - math.Exp(-1/(limiterRelease.Seconds()*float64(p.sampleRate)))
+	reduction := 1.0
+	for i := 0; i < frame.SampleCount; i++ {
+		gain := dbGain(from + (to-from)*float64(i+1)/float64(frame.SampleCount))
+		frameSamples := samples[i*channels : (i+1)*channels]
+		peak := 0.0
+		for j := range frameSamples {
+			frameSamples[j] *= gain
+			peak = math.Max(peak, math.Abs(frameSamples[j]))
+		}
+		if p.config.Limiter {
+			p.limiter += (1 - p.limiter) * release
+			if peak*p.limiter > ceiling {
+				p.limiter = ceiling / peak
+			}
+			for j := range frameSamples {
+				frameSamples[j] *= p.limiter
+			}
+			reduction = math.Min(reduction, p.limiter)
+		}
+	}
+
+	p.Lock()
+	p.measured.Gain = to
+	p.measured.Reduction = 20 * math.Log10(1/reduction)
+	p.Unlock()
+
+	return writeSamples(frame, samples)
+}
+
+// measure runs the K-weighted samples into the steps and gating blocks.
+func (p *loudnessProcessor) measure(samples []float64) {
+
+	channels := len(p.weights)
+	stepSize := int(loudnessStep.Seconds() * float64(p.sampleRate))
+	for i := 0; i+channels <= len(samples); i += channels {
+		for c := 0; c < channels; c++ {
+			y := p.highpasses[c].filter(p.shelves[c].filter(samples[i+c]))
+			p.stepEnergy += p.weights[c] * y * y
+		}
+		p.stepSamples++
+		if p.stepSamples == stepSize {
+			p.endStep(p.stepEnergy / float64(stepSize))
+			p.stepEnergy = 0
+			p.stepSamples = 0
+		}
+	}
+}
+
+func (p *loudnessProcessor) endStep(energy float64) {
+
+	shortTerm := int(3 * time.Second / loudnessStep)
+	p.steps = append(p.steps, energy)
+	if len(p.steps) > shortTerm {
+		p.steps = p.steps[len(p.steps)-shortTerm:]
+	}
+	if len(p.steps) < 4 {
+		return
+	}
+
+	block := mean(p.steps[len(p.steps)-4:])
+	window := int(normalizeWindow / loudnessStep)
+	p.blocks = append(p.blocks, block)
+	if len(p.blocks) > window {
+		p.blocks = p.blocks[len(p.blocks)-window:]
+	}
+	if lufs := energyLUFS(block); lufs > absoluteGate {
+		bin := int((lufs - absoluteGate) / histogramStep)
+		if bin >= histogramBins {
+			bin = histogramBins - 1
+		}
+		p.histogram[bin]++
+		p.histogramEnergy[bin] += block
+	}
+
+	p.Lock()
+	p.measured.Momentary = energyLUFS(block)
+	p.measured.ShortTerm = energyLUFS(mean(p.steps))
+	p.measured.Integrated = p.integrated()
+	p.Unlock()
+}
+
+// integrated is the gated loudness of the histogram.
+func (p *loudnessProcessor) integrated() float64 {
+
+	count, energy := 0, 0.0
+	for i := range p.histogram {
+		count += p.histogram[i]
+		energy += p.histogramEnergy[i]
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	threshold := energyLUFS(energy/float64(count)) + relativeGate
+	count, energy = 0, 0
+	for i := range p.histogram {
+		if absoluteGate+float64(i+1)*histogramStep > threshold {
+			count += p.histogram[i]
+			energy += p.histogramEnergy[i]
+		}
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return energyLUFS(energy / float64(count))
+}
+
+// normalizationGain moves the gain towards the target for the gated loudness
+// of the window, by at most gainSlew per second.
+func (p *loudnessProcessor) normalizationGain(dur time.Duration) float64 {
+
+	loudness := gated(p.blocks)
+	if math.IsInf(loudness, -1) {
+		return p.gain
+	}
+
+	target := math.Min(p.config.TargetLUFS-loudness, p.config.MaxGain)
+	step := gainSlew * dur.Seconds()
+	return p.gain + math.Max(-step, math.Min(step, target-p.gain))
+}
+
+// gated is the R128 gated loudness of block energies.
+func gated(blocks []float64) float64 {
+
+	above := []float64{}
+	for _, block := range blocks {
+		if energyLUFS(block) > absoluteGate {
+			above = append(above, block)
+		}
+	}
+	if len(above) == 0 {
+		return math.Inf(-1)
+	}
+
+	threshold := energyLUFS(mean(above)) + relativeGate
+	kept := []float64{}
+	for _, block := range above {
+		if energyLUFS(block) > threshold {
+			kept = append(kept, block)
+		}
+	}
+	return energyLUFS(mean(kept))
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// loudness returns the last measurement.
+func (p *loudnessProcessor) loudness() Loudness {
+
+	p.RLock()
+	defer p.RUnlock()
+	return p.measured
+}
+
+// readSamples returns the samples of a frame interleaved in [-1, 1].
+func readSamples(frame av.AudioFrame) ([]float64, error) {
+
+	channels := frame.ChannelLayout.Count()
+	size := frame.SampleFormat.BytesPerSample()
+	samples := make([]float64, frame.SampleCount*channels)
+	for i := range samples {
+		data, offset, err := sampleAt(frame, i, channels, size)
+		if err != nil {
+			return nil, err
+		}
+		switch frame.SampleFormat {
+		case av.S16, av.S16P:
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(data[offset:]))) / 32768
+		case av.S32, av.S32P:
+			samples[i] = float64(int32(binary.LittleEndian.Uint32(data[offset:]))) / 2147483648
+		case av.FLT, av.FLTP:
+			samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[offset:])))
+		}
+	}
+	return samples, nil
+}
+
+// writeSamples stores interleaved samples into the frame, clipping them.
+func writeSamples(frame av.AudioFrame, samples []float64) error {
+
+	channels := frame.ChannelLayout.Count()
+	size := frame.SampleFormat.BytesPerSample()
+	for i, sample := range samples {
+		data, offset, err := sampleAt(frame, i, channels, size)
+		if err != nil {
+			return err
+		}
+		sample = math.Max(-1, math.Min(1, sample))
+		switch frame.SampleFormat {
+		case av.S16, av.S16P:
+			binary.LittleEndian.PutUint16(data[offset:], uint16(int16(math.Min(sample*32768, 32767))))
+		case av.S32, av.S32P:
+			binary.LittleEndian.PutUint32(data[offset:], uint32(int32(math.Min(sample*2147483648, 2147483647))))
+		case av.FLT, av.FLTP:
+			binary.LittleEndian.PutUint32(data[offset:], math.Float32bits(float32(sample)))
+		}
+	}
+	return nil
+}
+
+// sampleAt locates the interleaved sample i in the planes of the frame.
+func sampleAt(frame av.AudioFrame, i int, channels int, size int) ([]byte, int, error) {
+
+	switch frame.SampleFormat {
+	case av.S16, av.S32, av.FLT:
+		if len(frame.Data) < 1 || len(frame.Data[0]) < (i+1)*size {
+			return nil, 0, fmt.Errorf("loudness: short %v frame", frame.SampleFormat)
+		}
+		return frame.Data[0], i * size, nil
+	case av.S16P, av.S32P, av.FLTP:
+		plane, index := i%channels, i/channels
+		if len(frame.Data) <= plane || len(frame.Data[plane]) < (index+1)*size {
+			return nil, 0, fmt.Errorf("loudness: short %v frame", frame.SampleFormat)
+		}
+		return frame.Data[plane], index * size, nil
+	}
+	return nil, 0, fmt.Errorf("loudness: sample format %v not supported", frame.SampleFormat)
+}
@@ -0,0 +1,103 @@
+package trans
+
+import (
+	"math"
+	"testing"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// measureTone runs seconds of a stereo 1kHz tone of peak level dBFS through
+// the processor, a level of -Inf is silence.
+func measureTone(t *testing.T, p *loudnessProcessor, seconds int, level float64) {
+
+	for n := 0; n < seconds*50; n++ {
+		if err := p.process(toneFrame(n, 1000, dbGain(level), av.CH_STEREO)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoudnessSine(t *testing.T) {
+
+	// EBU Tech 3341 case 1, -23dBFS in both channels is -23 LUFS
+	p := newLoudnessProcessor(LoudnessConfig{})
+	measureTone(t, p, 20, -23)
+
+	loudness := p.loudness()
+	for _, test := range []struct {
+		name  string
+		value float64
+	}{
+		{"momentary", loudness.Momentary},
+		{"short-term", loudness.ShortTerm},
+		{"integrated", loudness.Integrated},
+	} {
+		if math.Abs(test.value+23) > 0.1 {
+			t.Fatalf("%s loudness %.2f LUFS, want -23", test.name, test.value)
+		}
+	}
+}
+
+func TestLoudnessGating(t *testing.T) {
+
+	for _, test := range []struct {
+		name  string
+		level float64
+	}{
+		// under the absolute gate
+		{"silence", math.Inf(-1)},
+		// over the absolute gate, 20 LU under the tone
+		{"quiet", -43},
+	} {
+		p := newLoudnessProcessor(LoudnessConfig{})
+		measureTone(t, p, 10, -23)
+		measureTone(t, p, 20, test.level)
+
+		// the blocks over the change of level count in part
+		if integrated := p.loudness().Integrated; math.Abs(integrated+23) > 0.2 {
+			t.Fatalf("%s: integrated loudness %.2f LUFS, want -23", test.name, integrated)
+		}
+		if momentary := p.loudness().Momentary; momentary > -40 {
+			t.Fatalf("%s: momentary loudness %.2f LUFS", test.name, momentary)
+		}
+	}
+}
+
+func TestLoudnessLimiter(t *testing.T) {
+
+	const ceiling = -3.0
+	p := newLoudnessProcessor(LoudnessConfig{Gain: 12, Limiter: true, Ceiling: ceiling})
+
+	peak := 0.0
+	for n := 0; n < 300; n++ {
+		// a second quiet and a second 6dB over the ceiling after the gain,
+		// the limiter releases and has to catch the next onset at once
+		level := -30.0
+		if n/50%2 == 1 {
+			level = -9
+		}
+		frame := toneFrame(n, 1000, dbGain(level), av.CH_STEREO)
+		if err := p.process(frame); err != nil {
+			t.Fatal(err)
+		}
+		samples, err := readSamples(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range samples {
+			// one step of s16
+			if math.Abs(v) > dbGain(ceiling)+1.0/32768 {
+				t.Fatalf("frame %d: sample %.4f over the ceiling of %.4f", n, v, dbGain(ceiling))
+			}
+			peak = math.Max(peak, math.Abs(v))
+		}
+	}
+
+	if peak < dbGain(ceiling-0.5) {
+		t.Fatalf("peak %.4f far under the ceiling of %.4f", peak, dbGain(ceiling))
+	}
+	if reduction := p.loudness().Reduction; reduction < 5 || reduction > 7 {
+		t.Fatalf("limiter reduction %.2f dB, want 6", reduction)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build noffmpeg
+
+package trans
+
+// FFmpeg is nil, the noffmpeg build tag leaves it out.
+var FFmpeg Backend
+
+// newResampler returns the cgo-free resampler to the format.
+func newResampler(out audioFormat) frameResampler {
+	return newGoResampler(out)
+}
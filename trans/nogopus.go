@@ -0,0 +1,6 @@
+//go:build nogopus
+
+package trans
+
+// Gopus is nil, the nogopus build tag leaves it out.
+var Gopus Backend
@@ -0,0 +1,285 @@
+package trans
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpusApplication is the libopus application mode.
+type OpusApplication string
+
+const (
+	// OpusVoIP favours speech intelligibility
+	OpusVoIP OpusApplication = "voip"
+	// OpusAudio favours fidelity, for music
+	OpusAudio OpusApplication = "audio"
+	// OpusLowDelay disables the speech modes for the lowest latency
+	OpusLowDelay OpusApplication = "lowdelay"
+)
+
+// OpusConfig tunes the opus encoder, the zero value keeps the libopus
+// defaults: 20ms stereo frames in audio mode without FEC or DTX.
+type OpusConfig struct {
+	// Bitrate in bits per second, 6000 to 510000, 0 lets libopus choose
+	Bitrate int
+	// FEC adds in-band forward error correction. libopus only codes it
+	// for an expected PacketLoss percentage above 0, with FEC a PacketLoss
+	// of 0 means fecPacketLoss.
+	FEC        bool
+	PacketLoss int
+	// DTX stops sending during silence
+	DTX bool
+	// Complexity from 1 to 10, 0 keeps the default of 10
+	Complexity  int
+	Application OpusApplication
+	// FrameDuration is one of 2.5, 5, 10, 20, 40 or 60ms, 0 means 20ms
+	FrameDuration time.Duration
+	// Mono encodes one channel, for voice
+	Mono bool
+	// Backend encodes, nil is FFmpeg or Gopus in a build without ffmpeg.
+	// Gopus only takes the Application and FrameDuration options besides
+	// the bitrate, Validate rejects the others.
+	Backend Backend
+	// Multistream keeps sources of more than two channels as opus
+	// multistream for clients offering multiopus, the others get stereo
+	Multistream bool
+}
+
+// OpusMapping is the channel mapping of an opus multistream, see RFC 7845
+// section 5.1.1.
+type OpusMapping struct {
+	Streams int
+	Coupled int
+	// Mapping gives the stream channel of every output channel in vorbis order
+	Mapping []int
+}
+
+// opusSurroundMappings are the mapping family 1 layouts libopus encodes by
+// channel count.
+var opusSurroundMappings = map[int]OpusMapping{
+	3: {Streams: 2, Coupled: 1, Mapping: []int{0, 2, 1}},
+	4: {Streams: 2, Coupled: 2, Mapping: []int{0, 1, 2, 3}},
+	5: {Streams: 3, Coupled: 2, Mapping: []int{0, 4, 1, 2, 3}},
+	6: {Streams: 4, Coupled: 2, Mapping: []int{0, 4, 1, 2, 3, 5}},
+	7: {Streams: 4, Coupled: 3, Mapping: []int{0, 4, 1, 2, 3, 5, 6}},
+	8: {Streams: 5, Coupled: 3, Mapping: []int{0, 6, 1, 2, 3, 4, 5, 7}},
+}
+
+// OpusSurroundMapping returns the multistream mapping the encoder uses for
+// channels, false for mono, stereo and more than 8 channels.
+func OpusSurroundMapping(channels int) (OpusMapping, bool) {
+	mapping, ok := opusSurroundMappings[channels]
+	return mapping, ok
+}
+
+// fecPacketLoss is the loss percentage the encoder expects with FEC when the
+// config sets none, it makes libopus code the FEC the fmtp advertises
+const fecPacketLoss = 10
+
+var opusFrameDurations = []time.Duration{
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	40 * time.Millisecond,
+	60 * time.Millisecond,
+}
+
+// Validate checks the ranges libopus accepts.
+func (c OpusConfig) Validate() error {
+
+	if c.Bitrate != 0 && (c.Bitrate < 6000 || c.Bitrate > 510000) {
+		return fmt.Errorf("opus bitrate %d out of range 6000-510000", c.Bitrate)
+	}
+	if c.PacketLoss < 0 || c.PacketLoss > 100 {
+		return fmt.Errorf("opus packet loss %d out of range 0-100", c.PacketLoss)
+	}
+	if c.Complexity < 0 || c.Complexity > 10 {
+		return fmt.Errorf("opus complexity %d out of range 0-10", c.Complexity)
+	}
+
+	switch c.Application {
+	case "", OpusVoIP, OpusAudio, OpusLowDelay:
+	default:
+		return fmt.Errorf("unknown opus application %q", c.Application)
+	}
+
+	if c.FrameDuration != 0 {
+		valid := false
+		for _, dur := range opusFrameDurations {
+			valid = valid || c.FrameDuration == dur
+		}
+		if !valid {
+			return fmt.Errorf("invalid opus frame duration %v", c.FrameDuration)
+		}
+	}
+
+	backend := c.Backend
+	if backend == nil {
+		backend = defaultOpusBackend()
+	}
+	if backend == nil {
+		return fmt.Errorf("no opus backend in this build")
+	}
+	if backend == Gopus {
+		return c.validateGopus()
+	}
+	return nil
+}
+
+// validateGopus rejects the settings gopus has no control for, the fmtp
+// would advertise what the encoder does not do.
+func (c OpusConfig) validateGopus() error {
+
+	unsupported := []string{}
+	if c.FEC {
+		unsupported = append(unsupported, "FEC")
+	}
+	if c.PacketLoss != 0 {
+		unsupported = append(unsupported, "PacketLoss")
+	}
+	if c.DTX {
+		unsupported = append(unsupported, "DTX")
+	}
+	if c.Complexity != 0 {
+		unsupported = append(unsupported, "Complexity")
+	}
+	if c.Multistream {
+		// gopus encodes one or two channels only
+		unsupported = append(unsupported, "Multistream")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("the gopus backend does not support %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// Options are the ffmpeg libopus encoder options of the config.
+func (c OpusConfig) Options() map[string]string {
+
+	options := map[string]string{}
+	if c.Application != "" {
+		options["application"] = string(c.Application)
+	}
+	if c.FrameDuration != 0 {
+		options["frame_duration"] = strconv.FormatFloat(float64(c.FrameDuration)/float64(time.Millisecond), 'f', -1, 64)
+	}
+	if c.FEC {
+		options["fec"] = "1"
+	}
+	if loss := c.packetLoss(); loss > 0 {
+		options["packet_loss"] = strconv.Itoa(loss)
+	}
+	if c.DTX {
+		options["dtx"] = "1"
+	}
+	if c.Complexity > 0 {
+		options["compression_level"] = strconv.Itoa(c.Complexity)
+	}
+	return options
+}
+
+// packetLoss is the loss percentage the encoder expects.
+func (c OpusConfig) packetLoss() int {
+	if c.FEC && c.PacketLoss == 0 {
+		return fecPacketLoss
+	}
+	return c.PacketLoss
+}
+
+// FmtpLine is the opus fmtp advertising the encoder settings.
+func (c OpusConfig) FmtpLine() string {
+
+	stereo := "1"
+	if c.Mono {
+		stereo = "0"
+	}
+
+	params := []string{
+		"minptime=10",
+		"useinbandfec=" + boolParam(c.FEC),
+		"stereo=" + stereo,
+		"sprop-stereo=" + stereo,
+	}
+	if c.Bitrate != 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(c.Bitrate))
+	}
+	if c.DTX {
+		params = append(params, "usedtx=1")
+	}
+	return strings.Join(params, ";")
+}
+
+// MultiopusFmtpLine is the fmtp of the multiopus codec for mapping.
+func (c OpusConfig) MultiopusFmtpLine(mapping OpusMapping) string {
+
+	channels := make([]string, len(mapping.Mapping))
+	for i, channel := range mapping.Mapping {
+		channels[i] = strconv.Itoa(channel)
+	}
+
+	params := []string{
+		"channel_mapping=" + strings.Join(channels, ","),
+		"num_streams=" + strconv.Itoa(mapping.Streams),
+		"coupled_streams=" + strconv.Itoa(mapping.Coupled),
+		"minptime=10",
+		"useinbandfec=" + boolParam(c.FEC),
+	}
+	if c.Bitrate != 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(c.Bitrate))
+	}
+	if c.DTX {
+		params = append(params, "usedtx=1")
+	}
+	return strings.Join(params, ";")
+}
+
+func boolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// OpusPacketDuration reads the duration of an opus packet from its toc byte,
+// see RFC 6716 section 3.1.
+func OpusPacketDuration(packet []byte) (time.Duration, error) {
+
+	if len(packet) == 0 {
+		return 0, fmt.Errorf("empty opus packet")
+	}
+
+	toc := packet[0]
+	config := toc >> 3
+
+	var frame time.Duration
+	switch {
+	case config < 12:
+		// silk: 10, 20, 40, 60ms
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// hybrid: 10, 20ms
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// celt: 2.5, 5, 10, 20ms
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, fmt.Errorf("opus packet without frame count")
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+
+	if frames == 0 {
+		return 0, fmt.Errorf("opus packet without frames")
+	}
+	return frame * time.Duration(frames), nil
+}
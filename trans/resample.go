@@ -0,0 +1,136 @@
+package trans
+
+import (
+	"math"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// frameResampler converts decoded frames to one format, the ffmpeg
+// resampler and goResampler both are one.
+type frameResampler interface {
+	Resample(frame av.AudioFrame) (av.AudioFrame, error)
+	Close()
+}
+
+// goResampler converts the sample formats, channel layouts and rates
+// readSamples knows without cgo. Rates are interpolated linearly, fine for
+// speech and the 44.1k to 48k step of music. More channels are mixed down to
+// mono by their mean and to stereo by keeping the front pair, mono is copied
+// to every channel.
+type goResampler struct {
+	out audioFormat
+
+	in audioFormat
+	// last input sample of every channel, the interpolation continues from
+	// it into the next frame
+	last []float64
+	// position of the next output sample in the input frame, -1 is last
+	pos float64
+}
+
+func newGoResampler(out audioFormat) *goResampler {
+	return &goResampler{out: out}
+}
+
+func (r *goResampler) Resample(frame av.AudioFrame) (av.AudioFrame, error) {
+
+	if in := frameFormat(frame); in != r.in {
+		r.in = in
+		r.last = nil
+		r.pos = 0
+	}
+
+	samples, err := readSamples(frame)
+	if err != nil {
+		return av.AudioFrame{}, err
+	}
+	channels := r.out.channelLayout.Count()
+	samples = mixChannels(samples, frame.ChannelLayout.Count(), channels)
+	if frame.SampleRate != r.out.sampleRate {
+		samples = r.interpolate(samples, channels, float64(frame.SampleRate)/float64(r.out.sampleRate))
+	}
+
+	out := av.AudioFrame{
+		SampleFormat:  r.out.sampleFormat,
+		ChannelLayout: r.out.channelLayout,
+		SampleRate:    r.out.sampleRate,
+		SampleCount:   len(samples) / channels,
+	}
+	size := out.SampleCount * r.out.sampleFormat.BytesPerSample()
+	if r.out.sampleFormat.IsPlanar() {
+		for ch := 0; ch < channels; ch++ {
+			out.Data = append(out.Data, make([]byte, size))
+		}
+	} else {
+		out.Data = [][]byte{make([]byte, size*channels)}
+	}
+	if err = writeSamples(out, samples); err != nil {
+		return av.AudioFrame{}, err
+	}
+	return out, nil
+}
+
+func (r *goResampler) Close() {
+}
+
+// interpolate resamples interleaved samples by step input samples per
+// output sample.
+func (r *goResampler) interpolate(samples []float64, channels int, step float64) []float64 {
+
+	n := len(samples) / channels
+	if n == 0 {
+		return samples
+	}
+	if r.last == nil {
+		r.last = append([]float64(nil), samples[:channels]...)
+	}
+
+	at := func(i int, ch int) float64 {
+		if i < 0 {
+			return r.last[ch]
+		}
+		return samples[i*channels+ch]
+	}
+
+	out := make([]float64, 0, int(float64(n)/step+1)*channels)
+	for ; r.pos < float64(n-1); r.pos += step {
+		i := int(math.Floor(r.pos))
+		frac := r.pos - float64(i)
+		for ch := 0; ch < channels; ch++ {
+			a, b := at(i, ch), at(i+1, ch)
+			out = append(out, a+(b-a)*frac)
+		}
+	}
+	r.pos -= float64(n)
+	copy(r.last, samples[(n-1)*channels:])
+	return out
+}
+
+// mixChannels maps interleaved samples of in channels to out channels.
+func mixChannels(samples []float64, in int, out int) []float64 {
+
+	if in == out {
+		return samples
+	}
+
+	n := len(samples) / in
+	mixed := make([]float64, n*out)
+	for i := 0; i < n; i++ {
+		from := samples[i*in : (i+1)*in]
+		to := mixed[i*out : (i+1)*out]
+		switch {
+		case in == 1:
+			for ch := range to {
+				to[ch] = from[0]
+			}
+		case out == 1:
+			for _, v := range from {
+				to[0] += v / float64(in)
+			}
+		default:
+			copy(to, from)
+		}
+	}
+	return mixed
+}
@@ -0,0 +1,85 @@
+package trans
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+func floatBytes(samples []float32) []byte {
+	data := make([]byte, len(samples)*4)
+	for i, v := range samples {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(v))
+	}
+	return data
+}
+
+func TestGoResampler(t *testing.T) {
+
+	for _, test := range []struct {
+		name    string
+		in      av.ChannelLayout
+		out     av.ChannelLayout
+		inRate  int
+		outRate int
+		level   float64
+	}{
+		{"44.1k stereo to 48k mono", av.CH_STEREO, av.CH_MONO, 44100, 48000, 0.5},
+		{"48k mono to 48k stereo", av.CH_MONO, av.CH_STEREO, 48000, 48000, 0.5},
+		{"16k stereo to 48k stereo", av.CH_STEREO, av.CH_STEREO, 16000, 48000, 0.5},
+		{"48k stereo to 16k stereo", av.CH_STEREO, av.CH_STEREO, 48000, 16000, 0.5},
+	} {
+		out := audioFormat{test.outRate, test.out, av.S16}
+		r := newGoResampler(out)
+
+		const frames, size = 50, 1000
+		channels := test.in.Count()
+		var resampled []av.AudioFrame
+		for n := 0; n < frames; n++ {
+			planes := make([][]byte, channels)
+			for ch := range planes {
+				samples := make([]float32, size)
+				for i := range samples {
+					samples[i] = float32(test.level * math.Sin(2*math.Pi*440*float64(n*size+i)/float64(test.inRate)))
+				}
+				planes[ch] = floatBytes(samples)
+			}
+			frame, err := r.Resample(av.AudioFrame{
+				SampleFormat:  av.FLTP,
+				ChannelLayout: test.in,
+				SampleCount:   size,
+				SampleRate:    test.inRate,
+				Data:          planes,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.SampleRate != out.sampleRate || frame.ChannelLayout != out.channelLayout || frame.SampleFormat != av.S16 {
+				t.Fatalf("%s: frame format %d %v %v", test.name, frame.SampleRate, frame.ChannelLayout, frame.SampleFormat)
+			}
+			resampled = append(resampled, frame)
+		}
+
+		// the samples after the last input sample wait for the next frame
+		want := float64(frames*size) * float64(out.sampleRate) / float64(test.inRate)
+		held := float64(out.sampleRate)/float64(test.inRate) + 1
+		for ch := 0; ch < out.channelLayout.Count(); ch++ {
+			samples := channelSamples(t, resampled, ch)
+			if float64(len(samples)) > math.Ceil(want) || float64(len(samples)) < want-held {
+				t.Fatalf("%s: %d samples, want %.0f", test.name, len(samples), want)
+			}
+			if level := toneLevel(samples, 440, out.sampleRate); math.Abs(level-test.level) > 0.01 {
+				t.Fatalf("%s: channel %d tone level %.3f, want %.2f", test.name, ch, level, test.level)
+			}
+			// a step at a frame boundary shows as a jump over the slope of the tone
+			slope := 2 * math.Pi * 440 * test.level / float64(out.sampleRate)
+			for i := 1; i < len(samples); i++ {
+				if math.Abs(samples[i]-samples[i-1]) > slope*1.05+1.0/32768 {
+					t.Fatalf("%s: jump of %.4f at sample %d", test.name, samples[i]-samples[i-1], i)
+				}
+			}
+		}
+	}
+}
@@ -1,26 +1,65 @@
 package trans
 
 import (
-	"github.com/notedit/rtmp-lib/audio"
-	"github.com/notedit/rtmp-lib/av"
+	"fmt"
 	"time"
+
+	"github.com/notedit/rtmp-lib/av"
 )
 
 type Transformer struct {
+	inCodec          string
+	outCodec         string
 	inSampleFormat   av.SampleFormat
 	outSampleFormat  av.SampleFormat
 	inChannelLayout  av.ChannelLayout
 	outChannelLayout av.ChannelLayout
 	outbitrate       int
+	outOptions       map[string]string
+	backend          Backend
 	inSampleRate     int
 	outSampleRate    int
 	enc              av.AudioEncoder
 	dec              av.AudioDecoder
 	timeline         *av.Timeline
+
+	// source codec data, its packet durations tell the real decoded rate
+	inCodecData av.AudioCodecData
+	// format of the decoded frames and the one the encoder takes, the
+	// resampler converts between them
+	inFormat  audioFormat
+	encFormat audioFormat
+	resampler frameResampler
+
+	// processing between decoding and encoding, nil when off
+	loudness *loudnessProcessor
+}
+
+type audioFormat struct {
+	sampleRate    int
+	channelLayout av.ChannelLayout
+	sampleFormat  av.SampleFormat
 }
 
+func frameFormat(frame av.AudioFrame) audioFormat {
+	return audioFormat{frame.SampleRate, frame.ChannelLayout, frame.SampleFormat}
+}
+
+// sampleRates are the rates a decoded rate is rounded to
+var sampleRates = []int{7350, 8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000, 64000, 88200, 96000}
+
 func (t *Transformer) Setup() error {
-	dec, err := audio.NewAudioDecoderByName("aac")
+	if t.inCodec == "" {
+		t.inCodec = "aac"
+	}
+	if t.outCodec == "" {
+		t.outCodec = "libopus"
+	}
+	backend, err := t.backendOf(t.inCodec)
+	if err != nil {
+		return err
+	}
+	dec, err := backend.NewDecoder(t.inCodec)
 	if err != nil {
 		return err
 	}
@@ -32,23 +71,187 @@ func (t *Transformer) Setup() error {
 		return err
 	}
 	t.dec = dec
-	enc, err := audio.NewAudioEncoderByName("libopus")
+	t.inFormat = audioFormat{t.inSampleRate, t.inChannelLayout, t.inSampleFormat}
+	if err = t.setupEncoder(); err != nil {
+		return err
+	}
+	t.timeline = &av.Timeline{}
+	return nil
+}
+
+// SetLoudnessConfig turns on the loudness processing, call it before Setup
+func (t *Transformer) SetLoudnessConfig(config LoudnessConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	t.loudness = nil
+	if config.enabled() {
+		t.loudness = newLoudnessProcessor(config)
+	}
+	return nil
+}
+
+// Loudness returns the measured loudness of the decoded audio, false when the
+// loudness processing is off. It is safe to call while Do runs.
+func (t *Transformer) Loudness() (Loudness, bool) {
+	if t.loudness == nil {
+		return Loudness{}, false
+	}
+	return t.loudness.loudness(), true
+}
+
+// outFormat is the encoder format, the output settings left unset follow the
+// decoded frames
+func (t *Transformer) outFormat() audioFormat {
+	format := audioFormat{t.outSampleRate, t.outChannelLayout, t.outSampleFormat}
+	if format.sampleRate == 0 {
+		format.sampleRate = t.inFormat.sampleRate
+	}
+	if format.channelLayout == 0 {
+		format.channelLayout = t.inFormat.channelLayout
+	}
+	if format.sampleFormat == 0 {
+		format.sampleFormat = t.inFormat.sampleFormat
+	}
+	return format
+}
+
+// setupEncoder replaces the encoder with one for the current output format
+func (t *Transformer) setupEncoder() error {
+	format := t.outFormat()
+	backend, err := t.backendOf(t.outCodec)
 	if err != nil {
 		return err
 	}
-	enc.SetSampleRate(t.outSampleRate)
-	enc.SetSampleFormat(t.outSampleFormat)
-	enc.SetChannelLayout(t.outChannelLayout)
-	enc.SetBitrate(t.outbitrate)
-	err = enc.Setup()
+	enc, err := backend.NewEncoder(t.outCodec)
 	if err != nil {
 		return err
 	}
+	enc.SetSampleRate(format.sampleRate)
+	enc.SetSampleFormat(format.sampleFormat)
+	enc.SetChannelLayout(format.channelLayout)
+	enc.SetBitrate(t.outbitrate)
+	for key, val := range t.outOptions {
+		if err = enc.SetOption(key, val); err != nil {
+			enc.Close()
+			return err
+		}
+	}
+	if err = enc.Setup(); err != nil {
+		enc.Close()
+		return err
+	}
+	if t.enc != nil {
+		t.enc.Close()
+	}
 	t.enc = enc
+	t.encFormat = format
+	return nil
+}
+
+// decodedFormat is the real format of a decoded frame. The ffmpeg decoder
+// reports the rate it was set up with, HE-AAC doubles it with SBR, so the
+// rate comes from the samples decoded for the duration of the packet.
+func (t *Transformer) decodedFormat(frame av.AudioFrame, dur time.Duration) audioFormat {
+	format := frameFormat(frame)
+	if dur <= 0 || frame.SampleCount == 0 {
+		return format
+	}
+	rate := float64(frame.SampleCount) / dur.Seconds()
+	best := format.sampleRate
+	for _, sampleRate := range sampleRates {
+		if best == 0 || abs(float64(sampleRate)-rate) < abs(float64(best)-rate) {
+			best = sampleRate
+		}
+	}
+	format.sampleRate = best
+	return format
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+// reformat follows a change of the decoded format. The encoder is only set up
+// again when its own format follows, the samples it holds are dropped and
+// the timeline restarts at the next packet so they do not shift the output.
+func (t *Transformer) reformat(format audioFormat) error {
+	t.inFormat = format
+	if t.resampler != nil {
+		t.resampler.Close()
+		t.resampler = nil
+	}
+	if t.outFormat() == t.encFormat {
+		return nil
+	}
+	if err := t.setupEncoder(); err != nil {
+		return err
+	}
 	t.timeline = &av.Timeline{}
 	return nil
 }
 
+// resample converts a decoded frame to the encoder format
+func (t *Transformer) resample(frame av.AudioFrame) (av.AudioFrame, error) {
+	if frameFormat(frame) == t.encFormat {
+		return frame, nil
+	}
+	if t.resampler == nil {
+		t.resampler = newResampler(t.encFormat)
+	}
+	return t.resampler.Resample(frame)
+}
+
+// packetDurationer is the codec data of the codecs with known packet
+// durations, like aac
+type packetDurationer interface {
+	PacketDuration(data []byte) (time.Duration, error)
+}
+
+// inPacketDuration is the duration of a source packet, from the source codec
+// data when it knows it
+func (t *Transformer) inPacketDuration(data []byte) (time.Duration, error) {
+	if codec, ok := t.inCodecData.(packetDurationer); ok {
+		return codec.PacketDuration(data)
+	}
+	return t.dec.PacketDuration(data)
+}
+
+// backendOf picks the backend of a codec, only opus has a choice
+func (t *Transformer) backendOf(codec string) (Backend, error) {
+	switch {
+	case t.backend != nil && isOpus(codec):
+		return t.backend, nil
+	case FFmpeg != nil:
+		return FFmpeg, nil
+	case Gopus != nil && isOpus(codec):
+		return Gopus, nil
+	}
+	return nil, fmt.Errorf("no audio backend for %s in this build", codec)
+}
+
+// SetBackend sets the library coding the opus side, default is FFmpeg and
+// Gopus in a build without ffmpeg
+func (t *Transformer) SetBackend(backend Backend) error {
+	t.backend = backend
+	return nil
+}
+
+// SetInCodec sets the ffmpeg decoder name, default is aac
+func (t *Transformer) SetInCodec(name string) error {
+	t.inCodec = name
+	return nil
+}
+
+// SetOutCodec sets the ffmpeg encoder name, default is libopus
+func (t *Transformer) SetOutCodec(name string) error {
+	t.outCodec = name
+	return nil
+}
+
 func (t *Transformer) SetInSampleRate(samplerate int) error {
 	t.inSampleRate = samplerate
 	return nil
@@ -84,6 +287,34 @@ func (t *Transformer) SetOutBitrate(bitrate int) error {
 	return nil
 }
 
+// SetOutOption sets an ffmpeg encoder option, applied by Setup
+func (t *Transformer) SetOutOption(key string, val string) error {
+	if t.outOptions == nil {
+		t.outOptions = make(map[string]string)
+	}
+	t.outOptions[key] = val
+	return nil
+}
+
+// SetOpusConfig applies an opus encoder config, call it before Setup
+func (t *Transformer) SetOpusConfig(config OpusConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	t.outChannelLayout = av.CH_STEREO
+	if config.Mono {
+		t.outChannelLayout = av.CH_MONO
+	}
+	t.outbitrate = config.Bitrate
+	if config.Backend != nil {
+		t.backend = config.Backend
+	}
+	for key, val := range config.Options() {
+		t.SetOutOption(key, val)
+	}
+	return nil
+}
+
 func (t *Transformer) Do(pkt av.Packet) (out []av.Packet, err error) {
 
 	var dur time.Duration
@@ -98,11 +329,31 @@ func (t *Transformer) Do(pkt av.Packet) (out []av.Packet, err error) {
 		return
 	}
 
-	if dur,err = t.dec.PacketDuration(pkt.Data); err != nil {
+	if dur, err = t.inPacketDuration(pkt.Data); err != nil {
+		return
+	}
+
+	// ffmpeg can not tell the duration of some codecs (opus) from the packet
+	// size, their frames keep the reported rate
+	format := t.decodedFormat(frame, dur)
+	if format != t.inFormat {
+		if err = t.reformat(format); err != nil {
+			return
+		}
+	}
+	frame.SampleRate = format.sampleRate
+
+	t.timeline.Push(pkt.Time, frame.Duration())
+
+	if frame, err = t.resample(frame); err != nil {
 		return
 	}
 
-	t.timeline.Push(pkt.Time,dur)
+	if t.loudness != nil {
+		if err = t.loudness.process(frame); err != nil {
+			return
+		}
+	}
 
 	var _outpkts [][]byte
 	if _outpkts, err = t.enc.Encode(frame); err != nil {
@@ -120,7 +371,16 @@ func (t *Transformer) Do(pkt av.Packet) (out []av.Packet, err error) {
 	return
 }
 
+// CodecData returns the encoder codec data, used as the stream header when
+// the output goes into a container
+func (t *Transformer) CodecData() (av.AudioCodecData, error) {
+	return t.enc.CodecData()
+}
+
 func (t *Transformer) Close() {
 	t.enc.Close()
 	t.dec.Close()
+	if t.resampler != nil {
+		t.resampler.Close()
+	}
 }
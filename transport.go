@@ -5,7 +5,7 @@ import (
 	rtputil "github.com/notedit/rtc-rtmp/rtp"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v3"
 	"github.com/rs/zerolog/log"
 	uuid "github.com/satori/go.uuid"
 	"io"
@@ -13,18 +13,60 @@ import (
 	"time"
 )
 
-type RTCTransport struct {
-	id         string
-	media      webrtc.MediaEngine
-	api        *webrtc.API
-	pc         *webrtc.PeerConnection
-	videoTrack *webrtc.Track
-	audioTrack *webrtc.Track
+// rtcStream is the audio/video track pair of one router, the stream id is
+// the msid the remote side sees. A track is nil when its kind was not
+// requested.
+type rtcStream struct {
+	id     string
+	router *RTCRouter
+	audio  *rtcTrack
+	video  *rtcTrack
+}
 
-	videoBuffer *rtputil.RTPBuffer
-	audioBuffer *rtputil.RTPBuffer
+func (self *rtcStream) tracks() []*rtcTrack {
 
-	connected bool
+	tracks := []*rtcTrack{}
+	if self.audio != nil {
+		tracks = append(tracks, self.audio)
+	}
+	if self.video != nil {
+		tracks = append(tracks, self.video)
+	}
+	return tracks
+}
+
+type RTCTransport struct {
+	id  string
+	api *webrtc.API
+	pc  *webrtc.PeerConnection
+
+	streams []*rtcStream
+	// router ssrc to local track
+	tracks map[uint32]*rtcTrack
+
+	// h264 profile of the first video stream, the h264 codec advertises it
+	profile *profileLevelID
+	// opus fmtp of the first audio stream
+	opusFmtp string
+	// codecs the transceivers offer or answer, their payload types follow
+	// the remote offer. Multiopus is nil until a multichannel stream is
+	// subscribed, browsers without surround support choke on it.
+	opus      webrtc.RTPCodecParameters
+	multiopus *webrtc.RTPCodecParameters
+	pcmu      webrtc.RTPCodecParameters
+	pcma      webrtc.RTPCodecParameters
+	h264      webrtc.RTPCodecParameters
+	// audio codec the remote offer prefers, routers send this transport the
+	// packets of that variant when they have it and stereo opus otherwise
+	audio audioEncoding
+	// the remote offer only takes packetization-mode 0, routers send this
+	// transport their single nal unit packets
+	singleNAL bool
+
+	connected   bool
+	onCandidate func(*webrtc.ICECandidate)
+	onState     func(webrtc.PeerConnectionState)
+	onNegotiate func()
 
 	endpoint  string
 	localsdp  string
@@ -33,8 +75,28 @@ type RTCTransport struct {
 	sync.RWMutex
 }
 
+// NewRTCTransport creates a transport without streams, routers add theirs
+// with CreateSubscriber or AddSubscriber.
 func NewRTCTransport(id string, endpoint string) (*RTCTransport, error) {
 
+	transport := &RTCTransport{
+		id:       id,
+		endpoint: endpoint,
+		tracks:   make(map[uint32]*rtcTrack),
+	}
+
+	if err := transport.newPeerConnection(); err != nil {
+		return nil, err
+	}
+
+	return transport, nil
+}
+
+// newPeerConnection builds the PeerConnection, it lives as long as the
+// transport. An ice restart continues it, so the tracks keep their ssrcs,
+// sequence numbers and timestamps.
+func (self *RTCTransport) newPeerConnection() error {
+
 	rtcpfb := []webrtc.RTCPFeedback{
 		webrtc.RTCPFeedback{
 			Type: webrtc.TypeRTCPFBTransportCC,
@@ -48,15 +110,29 @@ func NewRTCTransport(id string, endpoint string) (*RTCTransport, error) {
 	}
 
 	s := webrtc.SettingEngine{}
-	s.SetConnectionTimeout(10*time.Second, 2*time.Second)
+	s.SetICETimeouts(5*time.Second, 10*time.Second, 2*time.Second)
 	s.SetLite(true)
-	s.SetTrickle(false)
-	ips := []string{endpoint}
-	s.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+	if self.endpoint != "" {
+		s.SetNAT1To1IPs([]string{self.endpoint}, webrtc.ICECandidateTypeHost)
+	}
 
-	m := webrtc.MediaEngine{}
-	m.RegisterCodec(webrtc.NewRTPOpusCodec(OpusPayloadType, 48000))
-	m.RegisterCodec(webrtc.NewRTPH264CodecExt(H264PayloadTYpe, 90000, rtcpfb))
+	// G.711 for gateways without opus, opus goes first in our offers
+	self.opus = newOpusCodec(OpusPayloadType, "")
+	self.pcmu = newG711Codec(audioPCMU)
+	self.pcma = newG711Codec(audioPCMA)
+	self.h264 = newH264Codec(H264PayloadTYpe, h264FmtpLine(defaultProfileLevelID, "1"), rtcpfb)
+
+	// the transceivers pick the codecs they use, the media engine only has
+	// to know them
+	m := &webrtc.MediaEngine{}
+	for _, codec := range []webrtc.RTPCodecParameters{self.opus, newMultiopusCodec(MultiopusPayloadType, 0, ""), self.pcmu, self.pcma} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	if err := m.RegisterCodec(self.h264, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
 	api := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m))
 
 	config := webrtc.Configuration{
@@ -65,44 +141,334 @@ func NewRTCTransport(id string, endpoint string) (*RTCTransport, error) {
 		SDPSemantics: webrtc.SDPSemanticsUnifiedPlan,
 	}
 
-	pc, _ := api.NewPeerConnection(config)
-
-	transport := &RTCTransport{
-		id:       id,
-		media:    m,
-		api:      api,
-		pc:       pc,
-		endpoint: endpoint,
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return err
 	}
 
-	streamID := uuid.NewV4().String()
-	audioTrack, err := pc.NewTrack(OpusPayloadType, DefaultOpusSSRC, uuid.NewV4().String(), streamID)
+	pc.OnConnectionStateChange(self.onConnectionState)
+	pc.OnICECandidate(self.onICECandidate)
+
+	self.api = api
+	self.pc = pc
+	go self.sendReports()
+
+	return nil
+}
+
+// addTrack adds a sendonly transceiver for the track and starts reading its
+// RTCP. The track takes the ssrc of the sender, updateCodecs sets its codecs.
+func (self *RTCTransport) addTrack(streamID string, track *rtcTrack) error {
 
+	track.track = &localTrack{id: track.id, streamID: streamID, kind: track.kind}
+
+	transceiver, err := self.pc.AddTransceiverFromTrack(track.track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	videoTrack, err := pc.NewTrack(H264PayloadTYpe, DefaultH264SSRC, uuid.NewV4().String(), streamID)
+	track.transceiver = transceiver
+	track.ssrc = uint32(transceiver.Sender().GetParameters().Encodings[0].SSRC)
 
-	if err != nil {
-		return nil, err
+	if track.kind == webrtc.RTPCodecTypeVideo {
+		self.handleVideoRTCP(track)
+	} else {
+		self.handleAudioRTCP(track)
 	}
+	return nil
+}
 
-	pc.OnConnectionStateChange(transport.onConnectionState)
+// codecsOf lists the codecs the transceivers of kind offer or answer, in the
+// order of preference. Once negotiated only codecs of the remote side are
+// left, pion refuses others. The caller holds the lock.
+func (self *RTCTransport) codecsOf(kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters {
 
-	audioTransceiver, _ := pc.AddTransceiverFromTrack(audioTrack, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
-	videoTransceiver, _ := pc.AddTransceiverFromTrack(videoTrack, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	codecs := []webrtc.RTPCodecParameters{self.h264}
+	if kind == webrtc.RTPCodecTypeAudio {
+		codecs = []webrtc.RTPCodecParameters{self.opus}
+		if self.multiopus != nil {
+			codecs = append(codecs, *self.multiopus)
+		}
+		codecs = append(codecs, self.pcmu, self.pcma)
+	}
 
-	transport.audioTrack = audioTrack
-	transport.videoTrack = videoTrack
+	if self.remotesdp == "" {
+		return codecs
+	}
 
-	transport.videoBuffer = rtputil.NewRTPBuffer(512)
-	transport.audioBuffer = rtputil.NewRTPBuffer(512)
-	
-	transport.handleAudioRTCP(audioTransceiver.Sender())
-	transport.handleVideoRTCP(videoTransceiver.Sender())
+	remote := remoteCodecNames(self.remotesdp, kind)
+	negotiated := []webrtc.RTPCodecParameters{}
+	for _, codec := range codecs {
+		if remote[encodingName(codec)] {
+			negotiated = append(negotiated, codec)
+		}
+	}
+	return negotiated
+}
 
-	return transport, nil
+// setCodecs sets the codecs of the track's transceiver and the payload type
+// its packets carry. The caller holds the lock.
+func (self *RTCTransport) setCodecs(track *rtcTrack) error {
+
+	if track.kind == webrtc.RTPCodecTypeVideo {
+		track.setPayloadType(uint8(self.h264.PayloadType))
+	} else {
+		track.setPayloadType(uint8(self.codecOf(track.encoding).PayloadType))
+	}
+
+	return track.transceiver.SetCodecPreferences(self.codecsOf(track.kind))
+}
+
+// updateCodecs passes codec changes to every transceiver. The caller holds
+// the lock.
+func (self *RTCTransport) updateCodecs() error {
+
+	for _, stream := range self.streams {
+		for _, track := range stream.tracks() {
+			if err := self.setCodecs(track); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addStream adds the requested tracks for the router, the ssrcs of the router
+// packets are mapped to the new tracks.
+func (self *RTCTransport) addStream(router *RTCRouter, audio bool, video bool) error {
+
+	self.Lock()
+
+	if self.stop {
+		self.Unlock()
+		return fmt.Errorf("transport %s is stopped", self.id)
+	}
+
+	for _, stream := range self.streams {
+		if stream.router == router {
+			self.Unlock()
+			return fmt.Errorf("transport %s already subscribes %s", self.id, router.streamURL)
+		}
+	}
+
+	if video {
+		if err := self.setProfile(router); err != nil {
+			self.Unlock()
+			return err
+		}
+	}
+	if audio && self.opusFmtp == "" {
+		self.opusFmtp = router.opusFmtp
+		self.opus.SDPFmtpLine = router.opusFmtp
+	}
+	if audio && self.multiopus == nil && router.multiopus != nil {
+		codec := newMultiopusCodec(MultiopusPayloadType, router.multiopus.Channels, router.multiopus.SDPFmtpLine)
+		self.multiopus = &codec
+	}
+
+	stream := &rtcStream{
+		id:     uuid.NewV4().String(),
+		router: router,
+	}
+	if audio {
+		stream.audio = self.newTrack(webrtc.RTPCodecTypeAudio)
+		stream.audio.encoding = self.encodingOf(router)
+	}
+	if video {
+		stream.video = self.newTrack(webrtc.RTPCodecTypeVideo)
+	}
+
+	for _, track := range stream.tracks() {
+		if err := self.addTrack(stream.id, track); err != nil {
+			self.Unlock()
+			return err
+		}
+	}
+
+	self.streams = append(self.streams, stream)
+	// the first stream sets the profile and the opus fmtp of all tracks
+	if err := self.updateCodecs(); err != nil {
+		self.Unlock()
+		return err
+	}
+	for _, track := range stream.tracks() {
+		for _, ssrc := range router.ssrcs(track.kind) {
+			self.tracks[ssrc] = track
+		}
+	}
+	negotiated := self.localsdp != "" || self.remotesdp != ""
+	self.Unlock()
+
+	if negotiated {
+		self.negotiationNeeded()
+	}
+	return nil
+}
+
+// removeStream removes the tracks of the router and returns how many streams
+// are left. The transceivers stop and their m-lines turn inactive, the
+// remaining tracks keep theirs.
+func (self *RTCTransport) removeStream(router *RTCRouter) int {
+
+	self.Lock()
+
+	var stream *rtcStream
+	for i, s := range self.streams {
+		if s.router == router {
+			stream = s
+			self.streams = append(self.streams[:i], self.streams[i+1:]...)
+			break
+		}
+	}
+
+	left := len(self.streams)
+	if stream == nil {
+		self.Unlock()
+		return left
+	}
+
+	for _, track := range stream.tracks() {
+		for _, ssrc := range router.ssrcs(track.kind) {
+			delete(self.tracks, ssrc)
+		}
+		if !self.stop {
+			self.pc.RemoveTrack(track.transceiver.Sender())
+		}
+	}
+	negotiated := !self.stop && (self.localsdp != "" || self.remotesdp != "")
+	self.Unlock()
+
+	if negotiated {
+		self.negotiationNeeded()
+	}
+	return left
+}
+
+// newTrack allocates a track, its ssrc is the one of the sender.
+func (self *RTCTransport) newTrack(kind webrtc.RTPCodecType) *rtcTrack {
+
+	return &rtcTrack{
+		id:     uuid.NewV4().String(),
+		kind:   kind,
+		buffer: rtputil.NewRTPBuffer(512),
+	}
+}
+
+// switchStream moves the tracks of one router to another, they keep their
+// ssrcs and continue their sequence numbers and timestamps. The audio track
+// takes the encoding the new router sends and its payload type.
+func (self *RTCTransport) switchStream(from *RTCRouter, to *RTCRouter) error {
+
+	self.Lock()
+	defer self.Unlock()
+
+	var stream *rtcStream
+	for _, s := range self.streams {
+		if s.router == to {
+			return fmt.Errorf("transport %s already subscribes %s", self.id, to.streamURL)
+		}
+		if s.router == from {
+			stream = s
+		}
+	}
+
+	if stream == nil {
+		return fmt.Errorf("transport %s does not subscribe %s", self.id, from.streamURL)
+	}
+
+	if stream.video != nil {
+		if err := self.setProfile(to); err != nil {
+			return err
+		}
+	}
+
+	stream.router = to
+	for _, track := range stream.tracks() {
+		for _, ssrc := range from.ssrcs(track.kind) {
+			delete(self.tracks, ssrc)
+		}
+		track.switched()
+		for _, ssrc := range to.ssrcs(track.kind) {
+			self.tracks[ssrc] = track
+		}
+	}
+	if stream.audio != nil {
+		// the new router may lack the variant of the negotiated codec
+		stream.audio.setEncoding(self.encodingOf(to))
+	}
+
+	return self.updateCodecs()
+}
+
+// setProfile checks the h264 profile of the router against the advertised
+// one, the first video stream sets it. The caller holds the lock.
+func (self *RTCTransport) setProfile(router *RTCRouter) error {
+
+	if router.videoCodec == nil {
+		return nil
+	}
+
+	if self.profile == nil {
+		profile := router.profile
+		self.profile = &profile
+		self.h264.SDPFmtpLine = h264FmtpLine(profile, packetizationMode(self.singleNAL))
+		return nil
+	}
+
+	if !self.profile.decodes(router.profile, true) {
+		return fmt.Errorf("stream %s has h264 profile-level-id %s, transport %s advertises %s", router.streamID, router.profile, self.id, self.profile)
+	}
+	return nil
+}
+
+// setKeyFrameOnly changes what the tracks of the router forward, see
+// RTCRouter.SetKeyFrameOnly.
+func (self *RTCTransport) setKeyFrameOnly(router *RTCRouter, keyFrameOnly bool, audio bool) error {
+
+	self.RLock()
+	defer self.RUnlock()
+
+	for _, stream := range self.streams {
+		if stream.router == router {
+			if stream.video != nil {
+				stream.video.setKeyFrameOnly(keyFrameOnly)
+			}
+			if stream.audio != nil {
+				stream.audio.setMuted(keyFrameOnly && !audio)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("transport %s does not subscribe %s", self.id, router.streamURL)
+}
+
+// streamKinds reports which tracks the transport has for the router.
+func (self *RTCTransport) streamKinds(router *RTCRouter) (audio bool, video bool) {
+
+	self.RLock()
+	defer self.RUnlock()
+
+	for _, stream := range self.streams {
+		if stream.router == router {
+			return stream.audio != nil, stream.video != nil
+		}
+	}
+	return false, false
+}
+
+// StreamID returns the msid of the router's tracks on this transport, empty
+// if the transport does not subscribe the router.
+func (self *RTCTransport) StreamID(router *RTCRouter) string {
+
+	self.RLock()
+	defer self.RUnlock()
+
+	for _, stream := range self.streams {
+		if stream.router == router {
+			return stream.id
+		}
+	}
+	return ""
 }
 
 func (self *RTCTransport) ID() string {
@@ -111,75 +477,357 @@ func (self *RTCTransport) ID() string {
 
 func (self *RTCTransport) GetLocalSDP(sdpType webrtc.SDPType) (string, error) {
 
-	var sdp webrtc.SessionDescription
+	self.RLock()
+	localsdp := self.localsdp
+	self.RUnlock()
+
+	if localsdp != "" {
+		return localsdp, nil
+	}
+
+	var desc webrtc.SessionDescription
 	var err error
 
-	if self.localsdp == "" {
-		if sdpType == webrtc.SDPTypeOffer {
-			sdp, err = self.pc.CreateOffer(nil)
+	if sdpType == webrtc.SDPTypeOffer {
+		desc, err = self.pc.CreateOffer(nil)
+	} else {
+		desc, err = self.pc.CreateAnswer(nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if desc, err = self.setLocalDescription(desc); err != nil {
+		return "", err
+	}
 
-		} else {
-			sdp, err = self.pc.CreateAnswer(nil)
-		}
-		err = self.pc.SetLocalDescription(sdp)
-		self.localsdp = sdp.SDP
+	self.Lock()
+	self.localsdp = desc.SDP
+	self.Unlock()
+	return desc.SDP, nil
+}
+
+// CreateOffer creates a sendonly offer from the server side, the remote peer
+// answers it through SetRemoteSDP. It is used for the first negotiation as
+// well as every renegotiation after it, each call returns a new offer.
+func (self *RTCTransport) CreateOffer() (string, error) {
+
+	if self.pc == nil {
+		return "", fmt.Errorf("peerconnection does not init yet")
 	}
 
-	return self.localsdp, err
+	offer, err := self.pc.CreateOffer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	if offer, err = self.setLocalDescription(offer); err != nil {
+		return "", err
+	}
+
+	self.Lock()
+	self.localsdp = offer.SDP
+	self.Unlock()
+	return offer.SDP, nil
 }
 
+// setLocalDescription applies a local description. Without trickle ice it
+// waits for the candidates and returns the description with them, gathering
+// starts over after an ice restart.
+func (self *RTCTransport) setLocalDescription(desc webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+
+	self.RLock()
+	trickle := self.onCandidate != nil
+	self.RUnlock()
+
+	gathered := webrtc.GatheringCompletePromise(self.pc)
+	if err := self.pc.SetLocalDescription(desc); err != nil {
+		return desc, err
+	}
+
+	if trickle {
+		return desc, nil
+	}
+
+	<-gathered
+	return *self.pc.LocalDescription(), nil
+}
+
+// SetRemoteSDP applies an offer or an answer. An offer with new ice
+// credentials restarts ice on the same PeerConnection, the tracks and their
+// routers carry on.
 func (self *RTCTransport) SetRemoteSDP(sdpstr string, sdpType webrtc.SDPType) error {
 
 	if self.pc == nil {
 		return fmt.Errorf("peerconnection does not init yet")
 	}
 
-	self.remotesdp = sdpstr
+	// browsers refuse or mis-decode a stream of another h264 profile. Server
+	// offers only have packetization-mode 1, so only offers may use mode 0.
+	if self.profile != nil {
+		if err := checkH264Profile(sdpstr, sdpType, *self.profile, sdpType == webrtc.SDPTypeOffer); err != nil {
+			return err
+		}
+	}
+
 	sdp := webrtc.SessionDescription{SDP: sdpstr, Type: sdpType}
-	err := self.pc.SetRemoteDescription(sdp)
+	if err := self.pc.SetRemoteDescription(sdp); err != nil {
+		return err
+	}
+
+	self.Lock()
+	self.remotesdp = sdpstr
+	if sdpType == webrtc.SDPTypeOffer {
+		// a new offer needs a new answer
+		self.localsdp = ""
+	}
+	self.Unlock()
+
+	if sdpType == webrtc.SDPTypeOffer {
+		return self.followPayloadTypes(sdpstr)
+	}
+	return nil
+}
+
+// followPayloadTypes answers with the payload types of the offer, router
+// packets are rewritten to them per track. The audio codec the offer prefers
+// and the packetization mode of the h264 answer decide which packets the
+// routers send. The h264 answer keeps the offered profile with the level of
+// the stream.
+func (self *RTCTransport) followPayloadTypes(offer string) error {
+
+	self.Lock()
+
+	profile := defaultProfileLevelID
+	if self.profile != nil {
+		profile = *self.profile
+	}
+
+	singleNAL := false
+	encoding := audioOpus
+	audio, h264 := offeredFormats(offer, profile)
+	switch audio.name {
+	case opusName:
+		self.opus.PayloadType = webrtc.PayloadType(audio.payloadType)
+	case pcmuName:
+		encoding = audioPCMU
+		self.pcmu.PayloadType = webrtc.PayloadType(audio.payloadType)
+	case pcmaName:
+		encoding = audioPCMA
+		self.pcma.PayloadType = webrtc.PayloadType(audio.payloadType)
+	}
+	if encoding.isG711() {
+		// opus stays the fallback for routers without the g711 variant
+		if format := offeredAudio(offer, opusName, 2); format.name != "" {
+			self.opus.PayloadType = webrtc.PayloadType(format.payloadType)
+		}
+	}
+	if encoding == audioOpus && self.multiopus != nil {
+		if format := offeredAudio(offer, multiopus, int(self.multiopus.Channels)); format.name != "" {
+			encoding = audioMultiopus
+			self.multiopus.PayloadType = webrtc.PayloadType(format.payloadType)
+		}
+	}
+	if h264.name != "" {
+		self.h264.PayloadType = webrtc.PayloadType(h264.payloadType)
+		if remote, err := parseH264Fmtp(h264.fmtp); err == nil {
+			singleNAL = remote.packetizationMode == "0"
+			remote.profile.levelIdc = profile.levelIdc
+			self.h264.SDPFmtpLine = h264FmtpLine(remote.profile, remote.packetizationMode)
+		}
+	}
+
+	changed := self.singleNAL != singleNAL
+	self.singleNAL = singleNAL
+	self.audio = encoding
+	routers := []*RTCRouter{}
+	audioRouters := []*RTCRouter{}
+	audioEncodings := []audioEncoding{}
+	for _, stream := range self.streams {
+		if stream.audio != nil {
+			streamEncoding := self.encodingOf(stream.router)
+			if stream.audio.setEncoding(streamEncoding) {
+				// the other codec has its own sequence numbers and clock
+				stream.audio.switched()
+				audioRouters = append(audioRouters, stream.router)
+				audioEncodings = append(audioEncodings, streamEncoding)
+			}
+		}
+		if stream.video != nil && changed {
+			// the other packetization has its own sequence numbers
+			stream.video.switched()
+			routers = append(routers, stream.router)
+		}
+	}
+	err := self.updateCodecs()
+	self.Unlock()
 
+	// routers lock before transports, so they are told after the unlock
+	for _, router := range routers {
+		router.setSingleNAL(self, singleNAL)
+	}
+	for i, router := range audioRouters {
+		router.setAudioEncoding(self, audioEncodings[i])
+	}
 	return err
 }
 
+// codecOf is the codec of an audio encoding, the caller holds the lock.
+func (self *RTCTransport) codecOf(encoding audioEncoding) webrtc.RTPCodecParameters {
+
+	switch encoding {
+	case audioPCMU:
+		return self.pcmu
+	case audioPCMA:
+		return self.pcma
+	case audioMultiopus:
+		return *self.multiopus
+	}
+	return self.opus
+}
+
+// encodingOf is the audio encoding the router sends this transport, the
+// negotiated one or stereo opus when the router does not produce it. The
+// multiopus answer only fits the layout of the first multichannel stream.
+// The caller holds the lock.
+func (self *RTCTransport) encodingOf(router *RTCRouter) audioEncoding {
+
+	if !router.hasAudioVariant(self.audio) {
+		return audioOpus
+	}
+	if self.audio == audioMultiopus && router.multiopus.Channels != self.multiopus.Channels {
+		return audioOpus
+	}
+	return self.audio
+}
+
+func (self *RTCTransport) isSingleNAL() bool {
+
+	self.RLock()
+	defer self.RUnlock()
+	return self.singleNAL
+}
+
+// audioEncodingOf is the audio encoding the router sends this transport.
+func (self *RTCTransport) audioEncodingOf(router *RTCRouter) audioEncoding {
+
+	self.RLock()
+	defer self.RUnlock()
+	return self.encodingOf(router)
+}
+
+// OnICECandidate enables trickle ice, local candidates are passed to f instead
+// of being embedded in the local sdp. A nil candidate means gathering is done.
+// It has to be called before the first negotiation.
+func (self *RTCTransport) OnICECandidate(f func(*webrtc.ICECandidate)) error {
+
+	self.Lock()
+	defer self.Unlock()
+
+	if self.remotesdp != "" || self.localsdp != "" {
+		return fmt.Errorf("transport %s already negotiated", self.id)
+	}
+
+	self.onCandidate = f
+	return nil
+}
+
+// OnConnectionStateChange sets the handler for PeerConnection state changes.
+func (self *RTCTransport) OnConnectionStateChange(f func(webrtc.PeerConnectionState)) {
+	self.Lock()
+	self.onState = f
+	self.Unlock()
+}
+
+// OnNegotiationNeeded sets the handler called when the tracks of the
+// transport change, a server offering side should answer it with CreateOffer.
+func (self *RTCTransport) OnNegotiationNeeded(f func()) {
+	self.Lock()
+	self.onNegotiate = f
+	self.Unlock()
+}
+
+func (self *RTCTransport) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+
+	if self.pc == nil {
+		return fmt.Errorf("peerconnection does not init yet")
+	}
+
+	return self.pc.AddICECandidate(candidate)
+}
+
+// ApplySDPFrag handles a trickle ice PATCH body, see applySDPFrag.
+func (self *RTCTransport) ApplySDPFrag(frag *SDPFrag) (*SDPFrag, error) {
+
+	self.RLock()
+	remotesdp := self.remotesdp
+	self.RUnlock()
+
+	return applySDPFrag(self, remotesdp, frag)
+}
+
 func (self *RTCTransport) WriteRTP(packet *rtp.Packet) (err error) {
 
+	self.RLock()
+	defer self.RUnlock()
+
+	// packets before the connection are dropped
 	if !self.connected {
-		fmt.Println("transport does not connected ========")
 		return
 	}
 
-	if packet.SSRC == DefaultOpusSSRC {
-		self.audioBuffer.Add(packet)
-		err = self.audioTrack.WriteRTP(packet)
-	} else if packet.SSRC == DefaultH264SSRC {
-		self.videoBuffer.Add(packet)
-		err = self.videoTrack.WriteRTP(packet)
-	} else {
-		err = fmt.Errorf("ssrc does not exist")
+	track := self.tracks[packet.SSRC]
+	if track == nil {
+		return fmt.Errorf("ssrc does not exist")
+	}
+
+	out := track.rewrite(packet)
+	if out == nil {
+		return nil
 	}
-	return
+
+	track.buffer.Add(out)
+	if err = track.track.WriteRTP(out); err != nil {
+		return err
+	}
+	track.sent(out)
+	return nil
 }
 
 func (self *RTCTransport) Stop() (err error) {
+
+	self.Lock()
 	if self.stop {
+		self.Unlock()
 		return
 	}
-	err = self.pc.Close()
 	self.stop = true
-	return
+	pc := self.pc
+	self.Unlock()
+
+	return pc.Close()
 }
 
-func (self *RTCTransport) handleAudioRTCP(sender *webrtc.RTPSender) {
+func (self *RTCTransport) isStopped() bool {
+
+	self.RLock()
+	defer self.RUnlock()
+	return self.stop
+}
+
+func (self *RTCTransport) handleAudioRTCP(track *rtcTrack) {
+	sender := track.transceiver.Sender()
 	go func() {
 		for {
-			if self.stop {
+			if self.isStopped() {
 				return
 			}
-			pkts, err := sender.ReadRTCP()
+			pkts, _, err := sender.ReadRTCP()
 			if err != nil {
-				if err == io.EOF {
-					return
+				if err != io.EOF {
+					log.Debug().Msgf("read rtcp error %v", err)
 				}
+				return
 			}
 			for _, pkt := range pkts {
 				switch pkt.(type) {
@@ -189,10 +837,10 @@ func (self *RTCTransport) handleAudioRTCP(sender *webrtc.RTPSender) {
 					for _, nackPair := range nack.Nacks {
 
 						for _, seq := range nackPair.PacketList() {
-							rtpPkt := self.audioBuffer.Get(seq)
+							rtpPkt := track.buffer.Get(seq)
 							if rtpPkt != nil {
 								//log.Debug().Msgf("ssrc %d  packet seq %d", nack.SenderSSRC, nackPair.LostPackets())
-								self.audioTrack.WriteRTP(rtpPkt)
+								track.track.WriteRTP(rtpPkt)
 								continue
 							}
 							log.Debug().Msgf("rtp buffer can not find  %d", seq)
@@ -205,17 +853,19 @@ func (self *RTCTransport) handleAudioRTCP(sender *webrtc.RTPSender) {
 	}()
 }
 
-func (self *RTCTransport) handleVideoRTCP(sender *webrtc.RTPSender) {
+func (self *RTCTransport) handleVideoRTCP(track *rtcTrack) {
+	sender := track.transceiver.Sender()
 	go func() {
 		for {
-			if self.stop {
+			if self.isStopped() {
 				return
 			}
-			pkts, err := sender.ReadRTCP()
+			pkts, _, err := sender.ReadRTCP()
 			if err != nil {
-				if err == io.EOF {
-					return
+				if err != io.EOF {
+					log.Debug().Msgf("read rtcp error %v", err)
 				}
+				return
 			}
 			for _, pkt := range pkts {
 				switch pkt.(type) {
@@ -223,14 +873,12 @@ func (self *RTCTransport) handleVideoRTCP(sender *webrtc.RTPSender) {
 					nack := pkt.(*rtcp.TransportLayerNack)
 					//log.Debug().Msg(nack.String())
 					for _, nackPair := range nack.Nacks {
-
-						fmt.Println("nack  ====", nackPair.PacketList())
-
+						log.Debug().Msgf("transport %s nack %v", self.id, nackPair.PacketList())
 						for _, seq := range nackPair.PacketList() {
-							rtpPkt := self.videoBuffer.Get(seq)
+							rtpPkt := track.buffer.Get(seq)
 							if rtpPkt != nil {
 								//log.Debug().Msgf("ssrc %d  packet seq %d", nack.SenderSSRC, nackPair.LostPackets())
-								//self.videoTrack.WriteRTP(rtpPkt)
+								//track.track.WriteRTP(rtpPkt)
 								continue
 							}
 							log.Debug().Msgf("rtp buffer can not find  %d", seq)
@@ -251,7 +899,39 @@ func (self *RTCTransport) handleVideoRTCP(sender *webrtc.RTPSender) {
 func (self *RTCTransport) onConnectionState(state webrtc.PeerConnectionState) {
 
 	if state == webrtc.PeerConnectionStateConnected {
+		self.Lock()
 		self.connected = true
+		self.Unlock()
 		log.Debug().Msg("peerconnection connected")
 	}
+
+	self.RLock()
+	f := self.onState
+	self.RUnlock()
+
+	if f != nil {
+		f(state)
+	}
+}
+
+func (self *RTCTransport) negotiationNeeded() {
+
+	self.RLock()
+	f := self.onNegotiate
+	self.RUnlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+func (self *RTCTransport) onICECandidate(candidate *webrtc.ICECandidate) {
+
+	self.RLock()
+	f := self.onCandidate
+	self.RUnlock()
+
+	if f != nil {
+		f(candidate)
+	}
 }
@@ -0,0 +1,160 @@
+package rtcrtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// newSubscriberPeer is a local pion client receiving one audio track.
+func newSubscriberPeer(t *testing.T) (*webrtc.PeerConnection, chan *rtp.Packet, chan webrtc.ICEConnectionState) {
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{SDPSemantics: webrtc.SDPSemanticsUnifiedPlan})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan *rtp.Packet, 1000)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- packet:
+			default:
+			}
+		}
+	})
+
+	states := make(chan webrtc.ICEConnectionState, 16)
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		states <- state
+	})
+	return pc, packets, states
+}
+
+// negotiate sends an offer of the client to the transport and applies the
+// answer, it returns the answer.
+func negotiate(t *testing.T, pc *webrtc.PeerConnection, transport *RTCTransport, options *webrtc.OfferOptions) string {
+
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	if err = transport.SetRemoteSDP(pc.LocalDescription().SDP, webrtc.SDPTypeOffer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := transport.GetLocalSDP(webrtc.SDPTypeAnswer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+func waitICEState(t *testing.T, states chan webrtc.ICEConnectionState, want webrtc.ICEConnectionState) {
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("ice never got %s", want)
+		}
+	}
+}
+
+func readPacket(t *testing.T, packets chan *rtp.Packet) *rtp.Packet {
+
+	select {
+	case packet := <-packets:
+		return packet
+	case <-time.After(10 * time.Second):
+		t.Fatal("no media")
+	}
+	return nil
+}
+
+func TestTransportICERestart(t *testing.T) {
+
+	router := &RTCRouter{streamURL: "rtmp://localhost/live/test", audioSSRC: 1000}
+
+	transport, err := NewRTCTransport("restart", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Stop()
+	if err = transport.addStream(router, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, packets, states := newSubscriberPeer(t)
+	defer pc.Close()
+
+	answer := negotiate(t, pc, transport, nil)
+	waitICEState(t, states, webrtc.ICEConnectionStateConnected)
+
+	// one 20ms celt frame per packet
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		seq := uint16(100)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				transport.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: OpusPayloadType, SSRC: router.audioSSRC, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+					Payload: []byte{0xf8, 0xff, 0xfe},
+				})
+				seq++
+			}
+		}
+	}()
+
+	before := readPacket(t, packets)
+
+	restarted := negotiate(t, pc, transport, &webrtc.OfferOptions{ICERestart: true})
+	if iceUfrag(restarted) == iceUfrag(answer) {
+		t.Fatal("the answer to an ice restart keeps the ice credentials")
+	}
+	waitICEState(t, states, webrtc.ICEConnectionStateConnected)
+
+	// drain what was received before the restart completed
+	for len(packets) > 0 {
+		<-packets
+	}
+	after := readPacket(t, packets)
+
+	if after.SSRC != before.SSRC {
+		t.Fatalf("ssrc %d after the restart, %d before", after.SSRC, before.SSRC)
+	}
+	if gap := after.SequenceNumber - before.SequenceNumber; gap == 0 || gap > 1000 {
+		t.Fatalf("sequence number %d after the restart, %d before", after.SequenceNumber, before.SequenceNumber)
+	}
+}
@@ -0,0 +1,299 @@
+package rtcrtmp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const SDPContentType = "application/sdp"
+
+// ErrStreamNotFound is returned for a stream name without a source.
+var ErrStreamNotFound = fmt.Errorf("stream does not exist")
+
+type whepSession struct {
+	stream    string
+	router    *RTCRouter
+	transport *RTCTransport
+}
+
+// WHEPHandler serves the WebRTC-HTTP Egress Protocol on top of RTCRouter.
+//
+//	POST   {prefix}{stream}       offer in, 201 with answer and Location
+//	PATCH  {prefix}{stream}/{id}  trickle candidates or ice restart
+//	DELETE {prefix}{stream}/{id}  stop the subscriber
+//
+// One router is shared by all viewers of a stream and stopped with the last one.
+type WHEPHandler struct {
+	prefix    string
+	endpoint  string
+	streamURL func(stream string) string
+
+	routers  map[string]*RTCRouter
+	sessions map[string]*whepSession
+	sync.RWMutex
+}
+
+// NewWHEPHandler creates a handler mounted at prefix, streamURL maps the
+// stream name from the request path to the rtmp url the router pulls.
+func NewWHEPHandler(prefix string, endpoint string, streamURL func(stream string) string) *WHEPHandler {
+
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &WHEPHandler{
+		prefix:    prefix,
+		endpoint:  endpoint,
+		streamURL: streamURL,
+		routers:   make(map[string]*RTCRouter),
+		sessions:  make(map[string]*whepSession),
+	}
+}
+
+func (self *WHEPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !strings.HasPrefix(r.URL.Path, self.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, self.prefix), "/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Accept-Post", SDPContentType)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		self.handleOffer(w, r, name)
+	case http.MethodPatch:
+		self.handlePatch(w, r, path.Dir(name), path.Base(name))
+	case http.MethodDelete:
+		self.handleDelete(w, r, path.Dir(name), path.Base(name))
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (self *WHEPHandler) handleOffer(w http.ResponseWriter, r *http.Request, stream string) {
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), SDPContentType) {
+		http.Error(w, "content type must be "+SDPContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	router, transport, err := self.createSubscriber(stream, offerKinds(string(offer)))
+	if err == ErrStreamNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Debug().Msgf("whep subscribe %s error %v", stream, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err = transport.SetRemoteSDP(string(offer), webrtc.SDPTypeOffer); err != nil {
+		self.stopSession(&whepSession{stream, router, transport})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := transport.GetLocalSDP(webrtc.SDPTypeAnswer)
+	if err != nil {
+		self.stopSession(&whepSession{stream, router, transport})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the session is gone as soon as the transport closes or fails
+	id := transport.ID()
+	self.Lock()
+	self.sessions[id] = &whepSession{stream, router, transport}
+	self.Unlock()
+	transport.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			self.removeSession(id)
+		}
+	})
+
+	w.Header().Set("Content-Type", SDPContentType)
+	w.Header().Set("Location", self.prefix+stream+"/"+transport.ID())
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+func (self *WHEPHandler) handlePatch(w http.ResponseWriter, r *http.Request, stream string, id string) {
+
+	self.RLock()
+	session := self.sessions[id]
+	self.RUnlock()
+
+	// the id is only valid under the stream it was created for
+	if session == nil || session.stream != stream {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), SDPFragContentType) {
+		http.Error(w, "content type must be "+SDPFragContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := session.transport.ApplySDPFrag(ParseSDPFrag(string(body)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an ice restart is answered with the new credentials and candidates
+	if answer == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", SDPFragContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(answer.String()))
+}
+
+func (self *WHEPHandler) handleDelete(w http.ResponseWriter, r *http.Request, stream string, id string) {
+
+	self.RLock()
+	session := self.sessions[id]
+	self.RUnlock()
+
+	if session == nil || session.stream != stream {
+		http.NotFound(w, r)
+		return
+	}
+
+	self.removeSession(id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeSession stops the session once, DELETE and the transport closing
+// both end up here.
+func (self *WHEPHandler) removeSession(id string) {
+
+	self.Lock()
+	session := self.sessions[id]
+	delete(self.sessions, id)
+	self.Unlock()
+
+	if session != nil {
+		self.stopSession(session)
+	}
+}
+
+// createSubscriber dials the router of a stream without holding the lock,
+// the first of concurrent dials wins and the others are stopped.
+func (self *WHEPHandler) createSubscriber(stream string, kinds []webrtc.RTPCodecType) (*RTCRouter, *RTCTransport, error) {
+
+	for {
+		// a router that stopped on its own is replaced by a new one
+		self.RLock()
+		router, ok := self.routers[stream]
+		self.RUnlock()
+
+		var dialed *RTCRouter
+		if !ok || router.Err() != nil {
+			streamURL := self.streamURL(stream)
+			if streamURL == "" {
+				return nil, nil, ErrStreamNotFound
+			}
+
+			var err error
+			dialed, err = NewRTCRouter(streamURL, self.endpoint)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		self.Lock()
+		router, ok = self.routers[stream]
+		if !ok || router.Err() != nil {
+			// the router went away meanwhile, dial again
+			if dialed == nil {
+				self.Unlock()
+				continue
+			}
+			router = dialed
+			self.routers[stream] = router
+			dialed = nil
+		}
+		// under the lock the last session can not stop the router meanwhile
+		transport, err := router.CreateSubscriber(kinds...)
+		self.Unlock()
+
+		if dialed != nil {
+			dialed.Stop()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return router, transport, nil
+	}
+}
+
+func (self *WHEPHandler) stopSession(session *whepSession) {
+
+	session.transport.Stop()
+	session.router.StopSubscriber(session.transport)
+
+	self.Lock()
+	defer self.Unlock()
+
+	if session.router.SubscriberCount() == 0 && self.routers[session.stream] == session.router {
+		session.router.Stop()
+		delete(self.routers, session.stream)
+	}
+}
+
+// offerKinds returns the media kinds the offer can receive, an audio-only
+// offer gets an audio-only subscriber.
+func offerKinds(offer string) []webrtc.RTPCodecType {
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return nil
+	}
+
+	kinds := []webrtc.RTPCodecType{}
+	for _, media := range desc.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(media.MediaName.Media)
+		if kind == 0 || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute("sendonly"); ok {
+			continue
+		}
+		if _, ok := media.Attribute("inactive"); ok {
+			continue
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
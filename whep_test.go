@@ -0,0 +1,178 @@
+package rtcrtmp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp-lib/aac"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/pion/webrtc/v3"
+)
+
+// newTestRouter is a router of an aac source that is not pulled, the tests
+// only subscribe to it.
+func newTestRouter(t *testing.T) *RTCRouter {
+
+	codec, err := aac.NewCodecDataFromMPEG4AudioConfig(aac.MPEG4AudioConfig{
+		SampleRate:    44100,
+		ChannelLayout: av.CH_STEREO,
+		ObjectType:    aac.AOT_AAC_LC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &RTCRouter{
+		streamID:            "test",
+		streamURL:           "rtmp://localhost/live/test",
+		audioCodec:          codec,
+		audioSSRC:           1000,
+		outTransports:       make(map[string]*RTCTransport),
+		audioTransports:     make(map[string]*RTCTransport),
+		videoTransports:     make(map[string]*RTCTransport),
+		singleNALTransports: make(map[string]*RTCTransport),
+	}
+}
+
+func newTestWHEPHandler(t *testing.T) (*WHEPHandler, *RTCRouter) {
+
+	handler := NewWHEPHandler("/whep", "", func(stream string) string {
+		return ""
+	})
+	router := newTestRouter(t)
+	handler.routers["live/test"] = router
+	return handler, router
+}
+
+// whepOffer posts the gathered offer of pc and applies the answer.
+func whepOffer(t *testing.T, handler *WHEPHandler, pc *webrtc.PeerConnection) (string, string) {
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	w := whipRequest(handler, http.MethodPost, "/whep/live/test", SDPContentType, pc.LocalDescription().SDP, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("offer: %d %s", w.Code, w.Body.String())
+	}
+	answer := w.Body.String()
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	return w.Header().Get("Location"), answer
+}
+
+func TestWHEPStreamStatus(t *testing.T) {
+
+	offer := "v=0\r\n"
+
+	handler := NewWHEPHandler("/whep", "", func(stream string) string {
+		return ""
+	})
+	if w := whipRequest(handler, http.MethodPost, "/whep/live/test", SDPContentType, offer, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown stream: %d", w.Code)
+	}
+
+	// nothing listens on port 1, the stream exists but its source fails
+	handler = NewWHEPHandler("/whep", "", func(stream string) string {
+		return "rtmp://127.0.0.1:1/" + stream
+	})
+	if w := whipRequest(handler, http.MethodPost, "/whep/live/test", SDPContentType, offer, ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unreachable source: %d", w.Code)
+	}
+}
+
+func TestWHEPSessionRemovedOnClose(t *testing.T) {
+
+	handler, router := newTestWHEPHandler(t)
+
+	pc, _, _ := newSubscriberPeer(t)
+	defer pc.Close()
+	whepOffer(t, handler, pc)
+
+	handler.RLock()
+	sessions := []*whepSession{}
+	for _, session := range handler.sessions {
+		sessions = append(sessions, session)
+	}
+	handler.RUnlock()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions", len(sessions))
+	}
+
+	// a failed connection closes the transport the same way
+	sessions[0].transport.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		handler.RLock()
+		left := len(handler.sessions) + len(handler.routers)
+		handler.RUnlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session kept after the transport closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !router.isStopped() {
+		t.Fatal("router of the last session kept running")
+	}
+}
+
+func TestWHEPICERestart(t *testing.T) {
+
+	handler, router := newTestWHEPHandler(t)
+	defer router.Stop()
+
+	pc, _, states := newSubscriberPeer(t)
+	defer pc.Close()
+	location, answer := whepOffer(t, handler, pc)
+	waitICEState(t, states, webrtc.ICEConnectionStateConnected)
+
+	offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	local := answerSDPFrag(pc.LocalDescription().SDP)
+	w := whipRequest(handler, http.MethodPatch, location, SDPFragContentType, local.String(), "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != SDPFragContentType {
+		t.Fatalf("ice restart: %d %s", w.Code, w.Body.String())
+	}
+	frag := ParseSDPFrag(w.Body.String())
+	if frag.Ufrag == iceUfrag(answer) || frag.Pwd == "" || len(frag.Candidates) == 0 || !frag.EndOfCandidates {
+		t.Fatalf("ice restart answer %q", w.Body.String())
+	}
+
+	// the client completes the restart from the previous answer
+	restarted := restartSDP(answer, frag.Ufrag, frag.Pwd)
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: restarted}); err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range frag.ICECandidates() {
+		if err = pc.AddICECandidate(candidate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitICEState(t, states, webrtc.ICEConnectionStateConnected)
+
+	// trickled candidates of the same ice session have no answer
+	trickle := &SDPFrag{Ufrag: local.Ufrag, Mid: local.Mid}
+	if w = whipRequest(handler, http.MethodPatch, location, SDPFragContentType, trickle.String(), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("trickle: %d %s", w.Code, w.Body.String())
+	}
+}
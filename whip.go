@@ -0,0 +1,270 @@
+package rtcrtmp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notedit/rtmp-lib"
+	"github.com/notedit/rtmp-lib/pubsub"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+type whipSession struct {
+	stream   string
+	streamer *RTCStreamer
+}
+
+// WHIPHandler serves the WebRTC-HTTP Ingestion Protocol, every session is a
+// RTCStreamer writing to the PacketWriter returned by writer.
+//
+//	POST   {prefix}{stream}       offer in, 201 with answer and Location
+//	PATCH  {prefix}{stream}/{id}  trickle candidates or ice restart
+//	DELETE {prefix}{stream}/{id}  stop publishing
+//
+// A stream has one publisher, an offer for a published stream gets 409.
+type WHIPHandler struct {
+	prefix   string
+	endpoint string
+	token    string
+	writer   func(stream string) (PacketWriter, error)
+
+	sessions map[string]*whipSession
+	// streams with a live session, a stream has one publisher
+	publishing map[string]bool
+	sync.RWMutex
+}
+
+// NewWHIPHandler creates a handler mounted at prefix, writer opens the output
+// of the stream named by the request path, see RTMPWriter and QueueWriter.
+func NewWHIPHandler(prefix string, endpoint string, writer func(stream string) (PacketWriter, error)) *WHIPHandler {
+
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &WHIPHandler{
+		prefix:     prefix,
+		endpoint:   endpoint,
+		writer:     writer,
+		sessions:   make(map[string]*whipSession),
+		publishing: make(map[string]bool),
+	}
+}
+
+// SetToken enables bearer token auth, requests must carry
+// "Authorization: Bearer <token>".
+func (self *WHIPHandler) SetToken(token string) {
+	self.token = token
+}
+
+// RTMPWriter publishes every stream to the rtmp url returned by streamURL.
+func RTMPWriter(streamURL func(stream string) string) func(stream string) (PacketWriter, error) {
+	return func(stream string) (PacketWriter, error) {
+		conn, err := rtmp.DialTimeout(streamURL(stream), 3*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// QueueWriter writes every stream into the in-process queue returned by queue.
+func QueueWriter(queue func(stream string) (*pubsub.Queue, error)) func(stream string) (PacketWriter, error) {
+	return func(stream string) (PacketWriter, error) {
+		que, err := queue(stream)
+		if err != nil {
+			return nil, err
+		}
+		return que, nil
+	}
+}
+
+func (self *WHIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !strings.HasPrefix(r.URL.Path, self.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, self.prefix), "/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Accept-Post", SDPContentType)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !self.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		self.handleOffer(w, r, name)
+	case http.MethodPatch:
+		self.handlePatch(w, r, path.Dir(name), path.Base(name))
+	case http.MethodDelete:
+		self.handleDelete(w, r, path.Dir(name), path.Base(name))
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized compares the bearer token in constant time, so its bytes can
+// not be guessed from the response time.
+func (self *WHIPHandler) authorized(r *http.Request) bool {
+
+	if self.token == "" {
+		return true
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+self.token)) == 1
+}
+
+func (self *WHIPHandler) handleOffer(w http.ResponseWriter, r *http.Request, stream string) {
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), SDPContentType) {
+		http.Error(w, "content type must be "+SDPContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the stream is taken before its writer opens, a second publisher must
+	// not touch the output of the live one
+	self.Lock()
+	if self.publishing[stream] {
+		self.Unlock()
+		http.Error(w, "stream "+stream+" is already published", http.StatusConflict)
+		return
+	}
+	self.publishing[stream] = true
+	self.Unlock()
+
+	writer, err := self.writer(stream)
+	if err != nil {
+		self.release(stream)
+		log.Debug().Msgf("whip open %s error %v", stream, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	streamer, err := NewRTCStreamer(uuid.NewV4().String(), self.endpoint, writer)
+	if err != nil {
+		self.release(stream)
+		writer.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the session is gone as soon as the streamer closes, also when its
+	// connection fails
+	id := streamer.ID()
+	self.Lock()
+	self.sessions[id] = &whipSession{stream, streamer}
+	self.Unlock()
+	streamer.OnClose(func() {
+		self.Lock()
+		delete(self.sessions, id)
+		self.Unlock()
+		self.release(stream)
+	})
+
+	if err = streamer.SetRemoteSDP(string(offer), webrtc.SDPTypeOffer); err != nil {
+		streamer.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := streamer.GetLocalSDP(webrtc.SDPTypeAnswer)
+	if err != nil {
+		streamer.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", SDPContentType)
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%s", self.prefix, stream, id))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// release lets the stream be published again.
+func (self *WHIPHandler) release(stream string) {
+	self.Lock()
+	delete(self.publishing, stream)
+	self.Unlock()
+}
+
+func (self *WHIPHandler) handlePatch(w http.ResponseWriter, r *http.Request, stream string, id string) {
+
+	self.RLock()
+	session := self.sessions[id]
+	self.RUnlock()
+
+	// the id is only valid under the stream it was created for
+	if session == nil || session.stream != stream {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), SDPFragContentType) {
+		http.Error(w, "content type must be "+SDPFragContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := session.streamer.ApplySDPFrag(ParseSDPFrag(string(body)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an ice restart is answered with the new credentials and candidates
+	if answer == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", SDPFragContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(answer.String()))
+}
+
+func (self *WHIPHandler) handleDelete(w http.ResponseWriter, r *http.Request, stream string, id string) {
+
+	self.RLock()
+	session := self.sessions[id]
+	self.RUnlock()
+
+	if session == nil || session.stream != stream {
+		http.NotFound(w, r)
+		return
+	}
+
+	// closing removes the session
+	session.streamer.Close()
+	w.WriteHeader(http.StatusOK)
+}
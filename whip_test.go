@@ -0,0 +1,258 @@
+package rtcrtmp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtc-rtmp/trans"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pubsub"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+func whipRequest(handler http.Handler, method string, url string, contentType string, body string, token string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// newWHIPPublisher is a local pion client sending h264 and opus.
+func newWHIPPublisher(t *testing.T) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample) {
+
+	if trans.FFmpeg == nil {
+		t.Skip("publishing encodes aac, the build has no ffmpeg")
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{SDPSemantics: webrtc.SDPSemanticsUnifiedPlan})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "whip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "whip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendonly := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}
+	if _, err = pc.AddTransceiverFromTrack(audio, sendonly); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.AddTransceiverFromTrack(video, sendonly); err != nil {
+		t.Fatal(err)
+	}
+	return pc, video
+}
+
+func TestWHIPPublish(t *testing.T) {
+
+	que := pubsub.NewQueue()
+	handler := NewWHIPHandler("/whip", "", QueueWriter(func(stream string) (*pubsub.Queue, error) {
+		return que, nil
+	}))
+	handler.SetToken("secret")
+
+	pc, video := newWHIPPublisher(t)
+	defer pc.Close()
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: %d", w.Code)
+	}
+	if w := whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, "secreT"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", w.Code)
+	}
+
+	w := whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, "secret")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("offer: %d %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	answer, _ := ioutil.ReadAll(w.Body)
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	pps := []byte{0x68, 0xce, 0x06, 0xe2}
+	idr := append([]byte{0x65}, make([]byte, 3000)...)
+	frame := []byte{}
+	for _, nalu := range [][]byte{sps, pps, idr} {
+		frame = append(frame, 0, 0, 0, 1)
+		frame = append(frame, nalu...)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(30 * time.Millisecond):
+				video.WriteSample(media.Sample{Data: frame, Duration: 30 * time.Millisecond})
+			}
+		}
+	}()
+
+	type result struct {
+		streams []av.CodecData
+		pkt     av.Packet
+		err     error
+	}
+	read := make(chan result, 1)
+	go func() {
+		cursor := que.Oldest()
+		streams, err := cursor.Streams()
+		if err != nil {
+			read <- result{err: err}
+			return
+		}
+		pkt, err := cursor.ReadPacket()
+		read <- result{streams, pkt, err}
+	}()
+
+	select {
+	case got := <-read:
+		if got.err != nil {
+			t.Fatal(got.err)
+		}
+		if len(got.streams) != 2 || got.streams[rtcVideoIdx].Type() != av.H264 || got.streams[rtcAudioIdx].Type() != av.AAC {
+			t.Fatalf("streams %v", got.streams)
+		}
+		if got.pkt.Idx != rtcVideoIdx || !got.pkt.IsKeyFrame || len(got.pkt.Data) != 4+len(idr) {
+			t.Fatalf("first packet idx %d keyframe %v %d bytes", got.pkt.Idx, got.pkt.IsKeyFrame, len(got.pkt.Data))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no media in the queue")
+	}
+
+	other := strings.Replace(location, "/live/test/", "/live/other/", 1)
+	if w := whipRequest(handler, http.MethodDelete, other, "", "", "secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("delete under another stream: %d", w.Code)
+	}
+
+	restart := "a=ice-ufrag:abcd\r\na=ice-pwd:abcdefghijklmnopqrstuvwx\r\n"
+	w = whipRequest(handler, http.MethodPatch, location, SDPFragContentType, restart, "secret")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != SDPFragContentType {
+		t.Fatalf("ice restart: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	frag := ParseSDPFrag(w.Body.String())
+	if frag.Ufrag == "" || frag.Ufrag == iceUfrag(string(answer)) || len(frag.Candidates) == 0 {
+		t.Fatalf("ice restart answer %q", w.Body.String())
+	}
+
+	if w := whipRequest(handler, http.MethodDelete, location, "", "", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if w := whipRequest(handler, http.MethodDelete, location, "", "", "secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("second delete: %d", w.Code)
+	}
+}
+
+func TestWHIPSessionRemovedOnClose(t *testing.T) {
+
+	handler := NewWHIPHandler("/whip", "", QueueWriter(func(stream string) (*pubsub.Queue, error) {
+		return pubsub.NewQueue(), nil
+	}))
+
+	pc, _ := newWHIPPublisher(t)
+	defer pc.Close()
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("offer: %d %s", w.Code, w.Body.String())
+	}
+
+	handler.RLock()
+	sessions := []*whipSession{}
+	for _, session := range handler.sessions {
+		sessions = append(sessions, session)
+	}
+	handler.RUnlock()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions", len(sessions))
+	}
+
+	// a failed connection closes the streamer the same way
+	sessions[0].streamer.Close()
+
+	handler.RLock()
+	defer handler.RUnlock()
+	if len(handler.sessions) != 0 {
+		t.Fatal("session kept after the streamer closed")
+	}
+}
+
+func TestWHIPStreamConflict(t *testing.T) {
+
+	opened := map[string]int{}
+	handler := NewWHIPHandler("/whip", "", QueueWriter(func(stream string) (*pubsub.Queue, error) {
+		opened[stream]++
+		return pubsub.NewQueue(), nil
+	}))
+
+	pc, _ := newWHIPPublisher(t)
+	defer pc.Close()
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("offer: %d %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	if w = whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, ""); w.Code != http.StatusConflict {
+		t.Fatalf("second publisher: %d", w.Code)
+	}
+	if w = whipRequest(handler, http.MethodPost, "/whip/live/other", SDPContentType, offer.SDP, ""); w.Code != http.StatusCreated {
+		t.Fatalf("publisher of another stream: %d %s", w.Code, w.Body.String())
+	}
+
+	// the second publisher never opened the output of the live one
+	if opened["live/test"] != 1 {
+		t.Fatalf("output opened %d times", opened["live/test"])
+	}
+
+	if w = whipRequest(handler, http.MethodDelete, location, "", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if w = whipRequest(handler, http.MethodPost, "/whip/live/test", SDPContentType, offer.SDP, ""); w.Code != http.StatusCreated {
+		t.Fatalf("publisher after the session ended: %d %s", w.Code, w.Body.String())
+	}
+}